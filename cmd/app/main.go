@@ -1,16 +1,29 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/raphael-foliveira/htmbot/assets"
 	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/modules/auth"
 	"github.com/raphael-foliveira/htmbot/modules/chat"
+	"github.com/raphael-foliveira/htmbot/modules/completions"
+	"github.com/raphael-foliveira/htmbot/modules/search"
+	"github.com/raphael-foliveira/htmbot/modules/workspaces"
 	"github.com/raphael-foliveira/htmbot/platform/agents"
 	"github.com/raphael-foliveira/htmbot/platform/pubsub"
 )
@@ -23,6 +36,181 @@ func mustEnv(key string) string {
 	return value
 }
 
+func intEnv(key string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("environment variable %s must be an integer: %v", key, err)
+	}
+	return parsed
+}
+
+func durationEnv(key string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("environment variable %s must be a duration: %v", key, err)
+	}
+	return parsed
+}
+
+func newAgent() domain.LLMAgent {
+	switch os.Getenv("LLM_PROVIDER") {
+	case "anthropic":
+		return agents.NewAnthropic(mustEnv("ANTHROPIC_API_KEY"))
+	case "chat-completions":
+		return agents.NewChatCompletions(
+			mustEnv("LLM_BASE_URL"),
+			os.Getenv("LLM_API_KEY"),
+			mustEnv("LLM_MODEL"),
+		)
+	default:
+		return agents.NewOpenAI(mustEnv("OPENAI_API_KEY"))
+	}
+}
+
+func newQueue(pool *pgxpool.Pool) interface {
+	domain.MessageEnqueuer
+	domain.MessageConsumer
+} {
+	if os.Getenv("JOB_QUEUE") == "memory" {
+		return chat.NewInMemoryQueue(1000)
+	}
+	return chat.NewPGXQueue(pool, chat.PGXQueueConfig{})
+}
+
+// newSnapshots keeps the in-flight responses in memory along with the
+// in-memory pubsub, which already limits the app to a single instance.
+func newSnapshots(pool *pgxpool.Pool) domain.ResponseSnapshots {
+	if os.Getenv("PUBSUB") == "memory" {
+		return chat.NewSnapshots()
+	}
+	return chat.NewPGXSnapshots(pool, chat.PGXSnapshotsConfig{})
+}
+
+const superviseBackoff = 5 * time.Second
+
+// supervise runs fn until ctx is done, restarting it whenever it returns or
+// panics.
+func supervise(ctx context.Context, name string, fn func(context.Context) error) {
+	for {
+		err := runRecovered(ctx, fn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("%s exited, restarting in %s: %v", name, superviseBackoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(superviseBackoff):
+		}
+	}
+}
+
+func runRecovered(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+// newOIDC enables single sign-on when OIDC_ISSUER is set. OIDC_ALLOWED_GROUPS
+// restricts it to the users of a comma separated list of groups.
+// OIDC_GROUP_ROLES gives groups roles in workspaces as a comma separated list
+// of group=workspace-id:role entries.
+func newOIDC() *auth.OIDC {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	allowedGroups := []string{}
+	for group := range strings.SplitSeq(os.Getenv("OIDC_ALLOWED_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			allowedGroups = append(allowedGroups, group)
+		}
+	}
+
+	groupRoles := []auth.GroupRole{}
+	for entry := range strings.SplitSeq(os.Getenv("OIDC_GROUP_ROLES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		group, grant, _ := strings.Cut(entry, "=")
+		workspaceId, role, ok := strings.Cut(grant, ":")
+		if !ok {
+			log.Fatalf("OIDC_GROUP_ROLES entry %s must be group=workspace-id:role", entry)
+		}
+		groupRoles = append(groupRoles, auth.GroupRole{Group: group, WorkspaceID: workspaceId, Role: role})
+	}
+
+	provider, err := auth.NewOIDC(context.Background(), auth.OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      mustEnv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   mustEnv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+		EmailClaim:    os.Getenv("OIDC_EMAIL_CLAIM"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		AllowedGroups: allowedGroups,
+		GroupRoles:    groupRoles,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up single sign-on: %v", err)
+	}
+	return provider
+}
+
+type eventPublisher interface {
+	domain.PubSub[domain.ChatEvent]
+	Stats() pubsub.ChannelStats
+}
+
+func newPublisher(pool *pgxpool.Pool) eventPublisher {
+	if os.Getenv("PUBSUB") == "memory" {
+		return pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+	}
+
+	publisher := pubsub.NewPostgres[domain.ChatEvent](pool, "chat_events", pubsub.ChannelConfig{})
+	go supervise(context.Background(), "pubsub listener", publisher.Listen)
+	return publisher
+}
+
+func registerPublisherMetrics(publisher eventPublisher) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "htmbot_pubsub_dropped_events_total",
+		Help: "Events discarded because a subscriber's buffer was full.",
+	}, func() float64 {
+		return float64(publisher.Stats().Dropped)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "htmbot_pubsub_disconnected_subscribers_total",
+		Help: "Subscribers disconnected for falling behind.",
+	}, func() float64 {
+		return float64(publisher.Stats().Disconnected)
+	})
+}
+
+// serveMetrics exposes /metrics on METRICS_ADDR instead of the public
+// listener, so only whatever can reach that address can scrape it. It listens
+// on the loopback interface unless told otherwise.
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	addr := cmp.Or(os.Getenv("METRICS_ADDR"), "127.0.0.1:9090")
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
 func main() {
 	e := echo.New()
 
@@ -30,8 +218,7 @@ func main() {
 
 	e.StaticFS("/assets", assets.Assets)
 
-	apiKey := mustEnv("OPENAI_API_KEY")
-	agent := agents.NewOpenAI(apiKey)
+	agent := newAgent()
 
 	dbConn, err := pgxpool.New(context.Background(), mustEnv("DATABASE_URL"))
 	if err != nil {
@@ -39,21 +226,64 @@ func main() {
 	}
 
 	chatRepository := chat.NewPGXRepository(dbConn)
-	messagesChannel := make(chan domain.ChatEvent, 1000)
-	enqueuer := chat.NewMessageEnqueuer(messagesChannel)
-	publisher := pubsub.NewChannel(map[string][]chan domain.ChatEvent{})
+	queue := newQueue(dbConn)
+	publisher := newPublisher(dbConn)
+	registerPublisherMetrics(publisher)
+
+	runs := chat.NewRuns(publisher)
+	snapshots := newSnapshots(dbConn)
+
+	insecureCookies := os.Getenv("INSECURE_COOKIES") == "true"
+
+	userRepository := auth.NewPGXRepository(dbConn)
+	authService := auth.NewService(userRepository, auth.ServiceConfig{
+		ExternalSessionTTL: durationEnv("OIDC_SESSION_TTL"),
+	})
+	apiKeys := auth.NewAPIKeys(userRepository, userRepository)
+	authHandler := auth.NewHandler(authService, apiKeys, newOIDC(), auth.HandlerConfig{
+		InsecureCookies:  insecureCookies,
+		DisablePasswords: os.Getenv("DISABLE_PASSWORDS") == "true",
+	})
+	authHandler.Register(e)
 
-	chatService := chat.NewService(chatRepository, publisher, enqueuer)
+	workspaceRepository := workspaces.NewPGXRepository(dbConn)
+	workspaceService := workspaces.NewService(workspaceRepository)
+	workspaceHandler := workspaces.NewHandler(workspaceService, workspaces.HandlerConfig{
+		InsecureCookies: insecureCookies,
+	})
+	workspaceHandler.Register(e, authHandler.RequireUser)
+
+	chatService := chat.NewService(chatRepository, publisher, queue, runs, snapshots, workspaceService, agent)
 	chatHandler := chat.NewHandler(chatService)
-	chatHandler.Register(e)
+	chatHandler.Register(e, authHandler.RequireUser, workspaceHandler.RequireWorkspace)
+	chatAPIHandler := chat.NewAPIHandler(chatService)
+	chatAPIHandler.Register(e, authHandler.RequireAPIUser, workspaceHandler.RequireWorkspace)
+
+	completionService := completions.NewService(agent, chat.Tools(), chatRepository)
+	completionHandler := completions.NewHandler(completionService, completions.HandlerConfig{
+		Record: os.Getenv("COMPLETIONS_RECORD") == "true",
+	})
+	completionHandler.Register(e, authHandler.RequireAPIUser, workspaceHandler.RequireWorkspace)
+
+	searchRepository := search.NewPGXRepository(dbConn)
+	searchService := search.NewService(searchRepository)
+	searchHandler := search.NewHandler(searchService)
+	searchHandler.Register(e, authHandler.RequireUser, workspaceHandler.RequireWorkspace)
 
 	messagesProcessor := chat.NewMessageProcessor(
-		messagesChannel,
+		queue,
 		publisher,
 		agent,
 		chatRepository,
+		runs,
+		snapshots,
+		chat.MessageProcessorConfig{
+			Workers:    intEnv("MESSAGE_WORKERS"),
+			Registerer: prometheus.DefaultRegisterer,
+		},
 	)
-	go messagesProcessor.ProcessUserMessages(context.Background())
+	go supervise(context.Background(), "message processor", messagesProcessor.ProcessUserMessages)
+	go serveMetrics()
 
 	log.Fatal(e.Start(":8080"))
 }
@@ -0,0 +1,305 @@
+// Command mock-oidc is a minimal OpenID Connect issuer for trying single
+// sign-on locally. It supports the authorization code flow with PKCE and lets
+// the user pick the email and groups to sign in with. Point the app at it
+// with:
+//
+//	OIDC_ISSUER=http://localhost:9000
+//	OIDC_CLIENT_ID=htmbot
+//	OIDC_REDIRECT_URL=http://localhost:8080/auth/oidc/callback
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	keyID         = "mock-oidc"
+	codeLifetime  = time.Minute
+	tokenLifetime = time.Hour
+)
+
+type authorization struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	subject       string
+	email         string
+	groups        []string
+	expiresAt     time.Time
+}
+
+type issuer struct {
+	url      string
+	clientID string
+	key      *rsa.PrivateKey
+	signer   jose.Signer
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	addr := envOr("MOCK_OIDC_ADDR", ":9000")
+
+	i, err := newIssuer(
+		envOr("MOCK_OIDC_ISSUER", "http://localhost:9000"),
+		envOr("MOCK_OIDC_CLIENT_ID", "htmbot"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("mock OIDC issuer %s listening on %s", i.url, addr)
+	log.Fatal(http.ListenAndServe(addr, i.routes()))
+}
+
+// newIssuer creates an issuer with a fresh signing key.
+func newIssuer(url, clientID string) (*issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	return &issuer{
+		url:      url,
+		clientID: clientID,
+		key:      key,
+		signer:   signer,
+		codes:    map[string]authorization{},
+	}, nil
+}
+
+func (i *issuer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("GET /jwks", i.jwks)
+	mux.HandleFunc("GET /authorize", i.authorizeForm)
+	mux.HandleFunc("POST /authorize", i.authorize)
+	mux.HandleFunc("POST /token", i.token)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func (i *issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                i.url,
+		"authorization_endpoint":                i.url + "/authorize",
+		"token_endpoint":                        i.url + "/token",
+		"jwks_uri":                              i.url + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (i *issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       &i.key.PublicKey,
+			KeyID:     keyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}},
+	})
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"/><title>Mock OIDC sign-in</title></head>
+<body style="font-family: sans-serif; max-width: 30rem; margin: 4rem auto;">
+	<h1>Mock OIDC sign-in</h1>
+	<form method="post" action="/authorize" style="display: flex; flex-direction: column; gap: 1rem;">
+		{{range $name, $value := .Query}}<input type="hidden" name="{{$name}}" value="{{index $value 0}}"/>{{end}}
+		<label>Subject <input name="subject" value="mock-user" required/></label>
+		<label>Email <input name="email" type="email" value="mock.user@example.com" required/></label>
+		<label>Groups (comma separated) <input name="groups" value="users"/></label>
+		<button type="submit">Sign in</button>
+	</form>
+</body>
+</html>`))
+
+func (i *issuer) validateAuthorizeRequest(query url.Values) string {
+	switch {
+	case query.Get("client_id") != i.clientID:
+		return "unknown client_id"
+	case query.Get("response_type") != "code":
+		return "only the code response type is supported"
+	case query.Get("redirect_uri") == "":
+		return "redirect_uri is required"
+	case query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		return "an S256 code_challenge is required"
+	}
+	return ""
+}
+
+func (i *issuer) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if problem := i.validateAuthorizeRequest(query); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	authorizeTemplate.Execute(w, map[string]any{"Query": query})
+}
+
+func (i *issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problem := i.validateAuthorizeRequest(r.PostForm); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	groups := []string{}
+	for group := range strings.SplitSeq(r.PostForm.Get("groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	code := rand.Text()
+	i.mu.Lock()
+	i.codes[code] = authorization{
+		redirectURI:   r.PostForm.Get("redirect_uri"),
+		codeChallenge: r.PostForm.Get("code_challenge"),
+		nonce:         r.PostForm.Get("nonce"),
+		subject:       r.PostForm.Get("subject"),
+		email:         r.PostForm.Get("email"),
+		groups:        groups,
+		expiresAt:     time.Now().Add(codeLifetime),
+	}
+	i.mu.Unlock()
+
+	redirect, err := url.Parse(r.PostForm.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", r.PostForm.Get("state"))
+	redirect.RawQuery = query.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != i.clientID {
+		tokenError(w, "invalid_client", "unknown client_id")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	i.mu.Lock()
+	auth, ok := i.codes[r.PostForm.Get("code")]
+	delete(i.codes, r.PostForm.Get("code"))
+	i.mu.Unlock()
+
+	if !ok || time.Now().After(auth.expiresAt) {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != auth.redirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri doesn't match")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier doesn't match")
+		return
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iss":            i.url,
+		"sub":            auth.subject,
+		"aud":            i.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(tokenLifetime).Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.email,
+		"email_verified": true,
+		"groups":         auth.groups,
+	})
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	signed, err := i.signer.Sign(claims)
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+	idToken, err := signed.CompactSerialize()
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/modules/auth"
+)
+
+// userStore is an in-memory domain.UserRepository.
+type userStore struct {
+	mu       sync.Mutex
+	users    []domain.User
+	sessions map[string]string
+	// roles maps users to their role in each workspace.
+	roles map[string]map[string]string
+}
+
+func (s *userStore) find(match func(user domain.User) bool) (domain.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return domain.User{}, domain.ErrNotFound
+}
+
+func (s *userStore) create(user domain.User) (domain.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Email == user.Email {
+			return domain.User{}, domain.ErrEmailTaken
+		}
+	}
+	user.ID = fmt.Sprint(len(s.users) + 1)
+	user.CreatedAt = time.Now()
+	s.users = append(s.users, user)
+	return user, nil
+}
+
+func (s *userStore) CreateUser(ctx context.Context, email, passwordHash string) (domain.User, error) {
+	return s.create(domain.User{Email: email, PasswordHash: &passwordHash})
+}
+
+func (s *userStore) GetUser(ctx context.Context, userId string) (domain.User, error) {
+	return s.find(func(user domain.User) bool { return user.ID == userId })
+}
+
+func (s *userStore) GetUserByEmail(ctx context.Context, email string) (domain.User, error) {
+	return s.find(func(user domain.User) bool { return user.Email == email })
+}
+
+func (s *userStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (domain.User, error) {
+	return s.find(func(user domain.User) bool {
+		return user.OIDCIssuer != nil && *user.OIDCIssuer == issuer && *user.OIDCSubject == subject
+	})
+}
+
+func (s *userStore) CreateExternalUser(ctx context.Context, identity domain.ExternalIdentity) (domain.User, error) {
+	return s.create(domain.User{
+		Email:       identity.Email,
+		OIDCIssuer:  &identity.Issuer,
+		OIDCSubject: &identity.Subject,
+	})
+}
+
+func (s *userStore) UpdateExternalUser(ctx context.Context, userId string, identity domain.ExternalIdentity) (domain.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, user := range s.users {
+		if user.ID == userId {
+			user.Email = identity.Email
+			user.OIDCIssuer = &identity.Issuer
+			user.OIDCSubject = &identity.Subject
+			s.users[i] = user
+			return user, nil
+		}
+	}
+	return domain.User{}, domain.ErrNotFound
+}
+
+func (s *userStore) SyncWorkspaceRoles(ctx context.Context, userId string, roles map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.roles[userId] == nil {
+		s.roles[userId] = map[string]string{}
+	}
+	for workspaceId, role := range roles {
+		if role == "" {
+			delete(s.roles[userId], workspaceId)
+		} else {
+			s.roles[userId][workspaceId] = role
+		}
+	}
+	return nil
+}
+
+func (s *userStore) CreateSession(ctx context.Context, tokenHash, userId string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[tokenHash] = userId
+	return nil
+}
+
+func (s *userStore) GetSessionUser(ctx context.Context, tokenHash string) (domain.User, error) {
+	s.mu.Lock()
+	userId, ok := s.sessions[tokenHash]
+	s.mu.Unlock()
+
+	if !ok {
+		return domain.User{}, domain.ErrNotFound
+	}
+	return s.GetUser(ctx, userId)
+}
+
+func (s *userStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+// signOn runs the app's auth handler against the mock issuer, each on its own
+// test server.
+type signOn struct {
+	t       *testing.T
+	issuer  string
+	users   *userStore
+	service *auth.Service
+	app     string
+	client  *http.Client
+}
+
+// newSignOn sets up the flow with the OIDC settings of config, which the
+// issuer, client and redirect URL are filled into.
+func newSignOn(t *testing.T, config auth.OIDCConfig) *signOn {
+	i, err := newIssuer("", "htmbot")
+	if err != nil {
+		t.Fatalf("failed to create issuer: %v", err)
+	}
+	issuerServer := httptest.NewServer(i.routes())
+	t.Cleanup(issuerServer.Close)
+	i.url = issuerServer.URL
+
+	e := echo.New()
+	appServer := httptest.NewServer(e)
+	t.Cleanup(appServer.Close)
+
+	config.Issuer = i.url
+	config.ClientID = "htmbot"
+	config.RedirectURL = appServer.URL + "/auth/oidc/callback"
+	oidc, err := auth.NewOIDC(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to create OIDC client: %v", err)
+	}
+
+	users := &userStore{sessions: map[string]string{}, roles: map[string]map[string]string{}}
+	service := auth.NewService(users, auth.ServiceConfig{})
+	auth.NewHandler(service, auth.NewAPIKeys(nil, users), oidc, auth.HandlerConfig{InsecureCookies: true}).Register(e)
+
+	return &signOn{
+		t:       t,
+		issuer:  i.url,
+		users:   users,
+		service: service,
+		app:     appServer.URL,
+		client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// start begins a sign-on at the app, returning the issuer's authorize URL and
+// the state, verifier and nonce kept in the flow cookie.
+func (s *signOn) start() (*url.URL, []string) {
+	s.t.Helper()
+
+	response, err := s.client.Get(s.app + "/auth/oidc/login")
+	if err != nil {
+		s.t.Fatalf("failed to start sign-on: %v", err)
+	}
+	response.Body.Close()
+
+	flow := cookie(response, "oidc_flow")
+	if response.StatusCode != http.StatusFound || flow == "" {
+		s.t.Fatalf("got status %d and flow cookie %q, want a redirect with a flow cookie", response.StatusCode, flow)
+	}
+	return location(s.t, response), strings.Split(flow, ".")
+}
+
+// authorize signs in at the issuer as the given user and returns the
+// callback URL the issuer redirects back to.
+func (s *signOn) authorize(authorizeURL *url.URL, subject, email, groups string) *url.URL {
+	s.t.Helper()
+
+	if !strings.HasPrefix(authorizeURL.String(), s.issuer+"/authorize?") {
+		s.t.Fatalf("got redirect to %s, want the issuer's authorize endpoint", authorizeURL)
+	}
+
+	form := authorizeURL.Query()
+	form.Set("subject", subject)
+	form.Set("email", email)
+	form.Set("groups", groups)
+	response, err := s.client.PostForm(s.issuer+"/authorize", form)
+	if err != nil {
+		s.t.Fatalf("failed to authorize: %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusFound {
+		s.t.Fatalf("got status %d from the issuer, want %d", response.StatusCode, http.StatusFound)
+	}
+	return location(s.t, response)
+}
+
+// callback completes the sign-on with the given flow cookie, returning the
+// response along with its body.
+func (s *signOn) callback(callbackURL *url.URL, flow []string) (*http.Response, string) {
+	s.t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, callbackURL.String(), nil)
+	if err != nil {
+		s.t.Fatalf("failed to create callback request: %v", err)
+	}
+	request.AddCookie(&http.Cookie{Name: "oidc_flow", Value: strings.Join(flow, ".")})
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		s.t.Fatalf("failed to call back: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		s.t.Fatalf("failed to read callback response: %v", err)
+	}
+	return response, string(body)
+}
+
+// signIn runs the whole flow and returns the user the new session belongs
+// to.
+func (s *signOn) signIn(subject, email, groups string) domain.User {
+	s.t.Helper()
+
+	authorizeURL, flow := s.start()
+	response, body := s.callback(s.authorize(authorizeURL, subject, email, groups), flow)
+	if response.StatusCode != http.StatusFound || response.Header.Get("Location") != "/chat" {
+		s.t.Fatalf("got status %d redirecting to %q, want a redirect to /chat: %s",
+			response.StatusCode, response.Header.Get("Location"), body)
+	}
+
+	user, err := s.service.Authenticate(context.Background(), cookie(response, "session"))
+	if err != nil {
+		s.t.Fatalf("failed to authenticate the session: %v", err)
+	}
+	return user
+}
+
+func cookie(response *http.Response, name string) string {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func location(t *testing.T, response *http.Response) *url.URL {
+	t.Helper()
+
+	location, err := response.Location()
+	if err != nil {
+		t.Fatalf("failed to read redirect location: %v", err)
+	}
+	return location
+}
+
+func TestSignOnProvisionsUser(t *testing.T) {
+	s := newSignOn(t, auth.OIDCConfig{})
+
+	user := s.signIn("alice", "Alice@example.com", "users")
+	if user.Email != "alice@example.com" {
+		t.Errorf("got email %q, want alice@example.com", user.Email)
+	}
+	if user.OIDCIssuer == nil || *user.OIDCIssuer != s.issuer || user.OIDCSubject == nil || *user.OIDCSubject != "alice" {
+		t.Errorf("got identity %v %v, want %s alice", user.OIDCIssuer, user.OIDCSubject, s.issuer)
+	}
+	if user.PasswordHash != nil {
+		t.Error("provisioned user has a password")
+	}
+
+	again := s.signIn("alice", "alice@example.org", "users")
+	if again.ID != user.ID {
+		t.Errorf("signing in again gave user %s, want %s", again.ID, user.ID)
+	}
+	if again.Email != "alice@example.org" {
+		t.Errorf("got email %q after signing in again, want it synced to alice@example.org", again.Email)
+	}
+}
+
+func TestSignOnLinksVerifiedEmail(t *testing.T) {
+	s := newSignOn(t, auth.OIDCConfig{})
+
+	session, err := s.service.Signup(context.Background(), "bob@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("failed to sign up: %v", err)
+	}
+
+	user := s.signIn("bob", "bob@example.com", "users")
+	if user.ID != session.User.ID {
+		t.Errorf("got user %s, want the existing user %s", user.ID, session.User.ID)
+	}
+	if user.OIDCSubject == nil || *user.OIDCSubject != "bob" {
+		t.Errorf("got subject %v, want bob", user.OIDCSubject)
+	}
+	if user.PasswordHash == nil {
+		t.Error("linking removed the password")
+	}
+
+	// The email now belongs to a linked user, so it can't be taken over by
+	// another identity.
+	authorizeURL, flow := s.start()
+	response, body := s.callback(s.authorize(authorizeURL, "mallory", "bob@example.com", "users"), flow)
+	if response.StatusCode != http.StatusOK || !strings.Contains(body, domain.ErrEmailTaken.Error()) {
+		t.Errorf("got status %d, want the login page saying the email is taken: %s", response.StatusCode, body)
+	}
+	if token := cookie(response, "session"); token != "" {
+		t.Error("a session was started for another identity with the same email")
+	}
+}
+
+func TestSignOnRejectsTamperedFlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(callbackURL *url.URL, flow []string)
+		status int
+		error  string
+	}{
+		{
+			name: "state",
+			tamper: func(callbackURL *url.URL, flow []string) {
+				query := callbackURL.Query()
+				query.Set("state", rand.Text())
+				callbackURL.RawQuery = query.Encode()
+			},
+			status: http.StatusBadRequest,
+			error:  "invalid state",
+		},
+		{
+			name: "PKCE verifier",
+			tamper: func(callbackURL *url.URL, flow []string) {
+				flow[1] = rand.Text()
+			},
+			status: http.StatusOK,
+			error:  "sign-in failed",
+		},
+		{
+			name: "nonce",
+			tamper: func(callbackURL *url.URL, flow []string) {
+				flow[2] = rand.Text()
+			},
+			status: http.StatusOK,
+			error:  "sign-in failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSignOn(t, auth.OIDCConfig{})
+
+			authorizeURL, flow := s.start()
+			callbackURL := s.authorize(authorizeURL, "alice", "alice@example.com", "users")
+			test.tamper(callbackURL, flow)
+
+			response, body := s.callback(callbackURL, flow)
+			if response.StatusCode != test.status || !strings.Contains(body, test.error) {
+				t.Errorf("got status %d, want %d with %q: %s", response.StatusCode, test.status, test.error, body)
+			}
+			if token := cookie(response, "session"); token != "" {
+				t.Error("a session was started")
+			}
+			if len(s.users.users) != 0 {
+				t.Errorf("got %d users, want none provisioned", len(s.users.users))
+			}
+		})
+	}
+}
+
+func TestSignOnRequiresAllowedGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  string
+		allowed bool
+	}{
+		{name: "no groups", groups: "", allowed: false},
+		{name: "other group", groups: "users", allowed: false},
+		{name: "allowed group", groups: "users, staff", allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSignOn(t, auth.OIDCConfig{AllowedGroups: []string{"staff", "admins"}})
+
+			if test.allowed {
+				s.signIn("alice", "alice@example.com", test.groups)
+				return
+			}
+
+			authorizeURL, flow := s.start()
+			response, body := s.callback(s.authorize(authorizeURL, "alice", "alice@example.com", test.groups), flow)
+			if response.StatusCode != http.StatusOK || !strings.Contains(body, domain.ErrAccessDenied.Error()) {
+				t.Errorf("got status %d, want the login page saying access is denied: %s", response.StatusCode, body)
+			}
+			if token := cookie(response, "session"); token != "" {
+				t.Error("a session was started")
+			}
+			if len(s.users.users) != 0 {
+				t.Errorf("got %d users, want none provisioned", len(s.users.users))
+			}
+		})
+	}
+}
+
+func TestSignOnSyncsGroupRoles(t *testing.T) {
+	const engineering, support = "0b6c5f0e-8f7a-4d3c-9a52-6f1e2d3c4b5a", "7d9e1f2a-3b4c-4d5e-8f60-718293a4b5c6"
+	s := newSignOn(t, auth.OIDCConfig{
+		GroupRoles: []auth.GroupRole{
+			{Group: "engineers", WorkspaceID: engineering, Role: domain.WorkspaceEditor},
+			{Group: "leads", WorkspaceID: engineering, Role: domain.WorkspaceOwner},
+			{Group: "staff", WorkspaceID: support, Role: domain.WorkspaceViewer},
+		},
+	})
+
+	// Each sign-in starts from the roles the previous one left.
+	tests := []struct {
+		groups string
+		want   map[string]string
+	}{
+		{
+			groups: "engineers, staff",
+			want:   map[string]string{engineering: domain.WorkspaceEditor, support: domain.WorkspaceViewer},
+		},
+		{
+			groups: "engineers, leads",
+			want:   map[string]string{engineering: domain.WorkspaceOwner},
+		},
+		{
+			groups: "users",
+			want:   map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		user := s.signIn("alice", "alice@example.com", test.groups)
+		if got := s.users.roles[user.ID]; !maps.Equal(got, test.want) {
+			t.Errorf("signing in with groups %q gave roles %v, want %v", test.groups, got, test.want)
+		}
+	}
+}
+
+func TestOIDCConfigRejectsInvalidGroupRoles(t *testing.T) {
+	tests := []struct {
+		name      string
+		groupRole auth.GroupRole
+	}{
+		{
+			name:      "workspace",
+			groupRole: auth.GroupRole{Group: "staff", WorkspaceID: "support", Role: domain.WorkspaceViewer},
+		},
+		{
+			name:      "role",
+			groupRole: auth.GroupRole{Group: "staff", WorkspaceID: "7d9e1f2a-3b4c-4d5e-8f60-718293a4b5c6", Role: "admin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := auth.OIDCConfig{GroupRoles: []auth.GroupRole{test.groupRole}}
+			if err := config.Validate(); err == nil {
+				t.Error("got no error, want the group role rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// APIKey is a personal key for programmatic access. Only a hash of the key is
+// stored, Prefix is kept to tell keys apart.
+type APIKey struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	KeyHash    string     `json:"-" db:"key_hash"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Scopes limit what an API key can do: read chats, send messages to them,
+// or manage them (create, delete and change their settings).
+const (
+	ScopeRead   = "read"
+	ScopeSend   = "send"
+	ScopeManage = "manage"
+)
+
+var Scopes = []string{ScopeRead, ScopeSend, ScopeManage}
+
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, userId, name, prefix, keyHash string, scopes []string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error)
+	GetAPIKey(ctx context.Context, keyHash string) (APIKey, error)
+	DeleteAPIKey(ctx context.Context, userId, keyId string) error
+	TouchAPIKey(ctx context.Context, keyId string) error
+}
+
+// APIKeyService manages API keys. CreateAPIKey returns the key itself along
+// with its record, it can't be retrieved afterwards.
+type APIKeyService interface {
+	CreateAPIKey(ctx context.Context, userId, name string, scopes []string) (APIKey, string, error)
+	ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userId, keyId string) error
+	AuthenticateAPIKey(ctx context.Context, key string) (User, APIKey, error)
+}
+
+type apiKeyContextKey struct{}
+
+func WithAPIKey(ctx context.Context, key APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the API key the request was authenticated with,
+// if it wasn't authenticated with a session.
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(APIKey)
+	return key, ok
+}
+
+// HasScope reports whether the request may act within scope. Requests
+// authenticated with a session have every scope.
+func HasScope(ctx context.Context, scope string) bool {
+	key, ok := APIKeyFromContext(ctx)
+	return !ok || slices.Contains(key.Scopes, scope)
+}
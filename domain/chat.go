@@ -2,17 +2,56 @@ package domain
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 )
 
 type ChatSession struct {
-	ID        string    `json:"id" db:"id"`
-	Name      string    `json:"name" db:"name"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID            string    `json:"id" db:"id"`
+	Name          string    `json:"name" db:"name"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	SystemPrompt  string    `json:"system_prompt" db:"system_prompt"`
+	CurrentLeafID *string   `json:"current_leaf_id" db:"current_leaf_id"`
+	UserID        *string   `json:"user_id" db:"user_id"`
+	WorkspaceID   *string   `json:"workspace_id" db:"workspace_id"`
+	GenerationSettings
+}
+
+type GenerationSettings struct {
+	Model           string   `json:"model" db:"model"`
+	Temperature     *float64 `json:"temperature" db:"temperature"`
+	TopP            *float64 `json:"top_p" db:"top_p"`
+	MaxOutputTokens *int64   `json:"max_output_tokens" db:"max_output_tokens"`
+	ReasoningEffort string   `json:"reasoning_effort" db:"reasoning_effort"`
+}
+
+var ReasoningEfforts = []string{"low", "medium", "high"}
+
+func (g *GenerationSettings) Validate() error {
+	if g.Temperature != nil && (*g.Temperature < 0 || *g.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+
+	if g.TopP != nil && (*g.TopP < 0 || *g.TopP > 1) {
+		return fmt.Errorf("top_p must be between 0 and 1")
+	}
+
+	if g.MaxOutputTokens != nil && *g.MaxOutputTokens <= 0 {
+		return fmt.Errorf("max output tokens must be greater than 0")
+	}
+
+	if g.ReasoningEffort != "" && !slices.Contains(ReasoningEfforts, g.ReasoningEffort) {
+		return fmt.Errorf("invalid reasoning effort: %s", g.ReasoningEffort)
+	}
+
+	return nil
 }
 
 type ChatMessage struct {
 	ID               string    `json:"id" db:"id"`
+	ParentID         *string   `json:"parent_id" db:"parent_id"`
 	Role             string    `json:"role" db:"role"`
 	Content          string    `json:"content" db:"content"`
 	ChatSessionID    string    `json:"chat_session_id" db:"chat_session_id"`
@@ -21,38 +60,99 @@ type ChatMessage struct {
 	Args             *string   `json:"args" db:"args"`
 	CallID           *string   `json:"call_id" db:"call_id"`
 	Result           *string   `json:"result" db:"result"`
+	Cancelled        bool      `json:"cancelled" db:"cancelled"`
 	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	SiblingIDs       []string  `json:"sibling_ids" db:"-"`
 }
 
-type MessageEnqueuer interface {
-	EnqueueUserMessage(ctx context.Context, chatName, message string) error
+// SiblingPosition returns the 1-based position of the message among the
+// alternative branches that share its parent.
+func (m *ChatMessage) SiblingPosition() int {
+	return slices.Index(m.SiblingIDs, m.ID) + 1
+}
+
+var (
+	ErrRunCancelled = errors.New("run cancelled by the user")
+	ErrNotFound     = errors.New("not found")
+	ErrChatBusy     = errors.New("a response is still being generated")
+)
+
+// RunRegistry cancels the runs generating a response. The context returned by
+// Track is cancelled with ErrRunCancelled when Cancel is called for its chat,
+// until the returned function is called.
+type RunRegistry interface {
+	Track(ctx context.Context, chatId string) (context.Context, func())
+	Cancel(chatId string) error
+}
+
+// ResponseSnapshot is what has been streamed so far of a response that is
+// still being generated. ID is the ID of the delta it's streamed to and Seq
+// the last delta included in Text.
+type ResponseSnapshot struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Seq  int    `json:"seq"`
+}
+
+// ResponseSnapshots keeps the response in flight of each chat. Update appends
+// the text of the delta with the given seq.
+type ResponseSnapshots interface {
+	Start(chatId, deltaId string)
+	Update(chatId string, seq int, delta string)
+	Finish(chatId string)
+	Get(chatId string) (ResponseSnapshot, bool)
 }
 
 type ChatRepository interface {
 	GetMessages(ctx context.Context, params GetMessagesParams) ([]ChatMessage, error)
+	GetMessage(ctx context.Context, chatId, messageId string) (ChatMessage, error)
+	SelectBranch(ctx context.Context, chatId, messageId string) error
+	SetCurrentLeaf(ctx context.Context, chatId, messageId string) error
 	SaveMessage(ctx context.Context, sessionId string, messages ...ChatMessage) error
-	CreateChat(ctx context.Context, sessionId string) (ChatSession, error)
-	ListSessions(ctx context.Context) ([]ChatSession, error)
+	CreateChat(ctx context.Context, workspaceId, userId, name, systemPrompt string) (ChatSession, error)
+	ListSessions(ctx context.Context, workspaceId string) ([]ChatSession, error)
 	GetSessionName(ctx context.Context, chatId string) (string, error)
+	GetSession(ctx context.Context, chatId string) (ChatSession, error)
+	UpdateSettings(ctx context.Context, chatId string, settings GenerationSettings) (ChatSession, error)
+	UpdateSystemPrompt(ctx context.Context, chatId, systemPrompt string) (ChatSession, error)
 	DeleteSession(ctx context.Context, chatId string) error
 }
 
 type ChatService interface {
-	ListSessions(ctx context.Context) ([]ChatSession, error)
-	CreateChat(ctx context.Context, name string) (ChatSession, error)
-	GetChatPageData(ctx context.Context, chatId string) (ChatPageData, error)
+	ListSessions(ctx context.Context, workspaceId string) ([]ChatSession, error)
+	CreateChat(ctx context.Context, workspaceId, userId, name, systemPrompt string) (ChatSession, error)
+	// AuthorizeChat returns the user's membership of the chat's workspace. It
+	// returns ErrNotFound unless they're a member and ErrAccessDenied when
+	// their role there is less privileged than role.
+	AuthorizeChat(ctx context.Context, userId, chatId, role string) (WorkspaceMembership, error)
+	GetChatPageData(ctx context.Context, chatId, leafId string) (ChatPageData, error)
+	GetOlderMessages(ctx context.Context, chatId, beforeMessageId string) ([]ChatMessage, error)
 	SendMessage(ctx context.Context, chatId, text string) error
+	EditMessage(ctx context.Context, chatId, messageId, text string) error
+	RegenerateMessage(ctx context.Context, chatId, messageId string) error
+	SelectBranch(ctx context.Context, chatId, messageId string) error
 	DeleteChat(ctx context.Context, chatId string) error
-	SubscribeToMessages(chatId string) (chan ChatEvent, func(), error)
+	ValidateSettings(settings GenerationSettings) error
+	UpdateChatSettings(ctx context.Context, chatId string, settings GenerationSettings) (ChatSession, error)
+	UpdateSystemPrompt(ctx context.Context, chatId, systemPrompt string) (ChatSession, error)
+	CancelGeneration(ctx context.Context, chatId string) error
+	SubscribeToMessages(chatId string, lastEventId int64) (Subscription[ChatEvent], error)
+	GetInFlightResponse(chatId string) (ResponseSnapshot, bool)
 }
 
 type ChatPageData struct {
-	Name     string
-	Messages []ChatMessage
+	Name         string             `json:"name"`
+	SystemPrompt string             `json:"system_prompt"`
+	Settings     GenerationSettings `json:"settings"`
+	Messages     []ChatMessage      `json:"messages"`
+	InFlight     *ResponseSnapshot  `json:"in_flight"`
 }
 
+// GetMessagesParams selects a page of the path that ends at LeafID, or at the
+// chat's current leaf when LeafID is empty.
 type GetMessagesParams struct {
 	ChatSessionId string
+	LeafID        string
 	Before        time.Time
 	Limit         int
 }
@@ -68,10 +168,12 @@ func (g *GetMessagesParams) ApplyDefaults() {
 }
 
 type ChatEvent struct {
-	ChatSessionID string
-	Type          string
-	OfMessage     ChatMessage
-	OfDelta       ChatDelta
+	ChatSessionID string        `json:"chat_session_id"`
+	Type          string        `json:"type"`
+	OfMessage     ChatMessage   `json:"message,omitzero"`
+	OfDelta       ChatDelta     `json:"delta,omitzero"`
+	OfToolCall    ToolCallEvent `json:"tool_call,omitzero"`
+	OfFailure     ChatFailure   `json:"failure,omitzero"`
 }
 
 func (c *ChatEvent) Delta() ChatDelta {
@@ -82,7 +184,41 @@ func (c *ChatEvent) Message() ChatMessage {
 	return c.OfMessage
 }
 
+func (c *ChatEvent) ToolCall() ToolCallEvent {
+	return c.OfToolCall
+}
+
+func (c *ChatEvent) Failure() ChatFailure {
+	return c.OfFailure
+}
+
+// ChatDelta is a piece of a streamed response. Text is appended to what was
+// streamed before and Seq numbers the deltas of a response from 1, so that a
+// delta already included in a snapshot can be told apart.
+//
+// Settled holds the Markdown blocks completed by this delta, which render the
+// same whatever comes next, and Pending the block still being written.
 type ChatDelta struct {
-	ID   string
-	Text string
+	ID      string `json:"id"`
+	Text    string `json:"text"`
+	Seq     int    `json:"seq"`
+	Settled string `json:"settled"`
+	Pending string `json:"pending"`
+}
+
+// ChatFailure reports that no response could be generated for a user message.
+// ID is the ID of the delta the response was being streamed to.
+type ChatFailure struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+	Retrying  bool   `json:"retrying"`
+}
+
+type ToolCallEvent struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Args     string        `json:"args"`
+	Result   string        `json:"result"`
+	Error    string        `json:"error"`
+	Duration time.Duration `json:"duration"`
 }
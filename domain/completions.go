@@ -0,0 +1,41 @@
+package domain
+
+import (
+	"context"
+	"strings"
+)
+
+// CompletionRequest is a stateless conversation sent by an API client. When
+// Record is set the exchange is also stored as a new chat session of UserID,
+// in WorkspaceID.
+type CompletionRequest struct {
+	UserID      string
+	WorkspaceID string
+	Messages    []ChatMessage
+	Settings    GenerationSettings
+	Record      bool
+}
+
+// Completion holds the messages generated for a request, tool calls
+// included. ChatSessionID is set when the exchange was recorded.
+type Completion struct {
+	Messages      []ChatMessage
+	ChatSessionID string
+}
+
+// Text joins the assistant messages of the completion.
+func (c *Completion) Text() string {
+	parts := []string{}
+	for _, message := range c.Messages {
+		if message.Role == "assistant" && message.Content != "" {
+			parts = append(parts, message.Content)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+type CompletionService interface {
+	ValidateSettings(settings GenerationSettings) error
+	Complete(ctx context.Context, request CompletionRequest) (Completion, error)
+	StreamCompletion(ctx context.Context, request CompletionRequest, callback func(delta string)) (Completion, error)
+}
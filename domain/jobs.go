@@ -0,0 +1,34 @@
+package domain
+
+import "context"
+
+// MessageJob asks for an assistant response to a saved user message.
+type MessageJob struct {
+	ID            string `json:"id" db:"id"`
+	ChatSessionID string `json:"chat_session_id" db:"chat_session_id"`
+	MessageID     string `json:"message_id" db:"message_id"`
+	Attempts      int    `json:"attempts" db:"attempts"`
+	// Abandoned is set on a job whose last attempt never finished. The queue
+	// has already failed it and hands it out only so the failure is reported.
+	Abandoned bool `json:"abandoned" db:"abandoned"`
+}
+
+// MessageEnqueuer queues user messages to be answered. HasPendingJob reports
+// whether the chat has a job that is neither completed nor failed yet.
+type MessageEnqueuer interface {
+	EnqueueUserMessage(ctx context.Context, chatId string, message ChatMessage) error
+	HasPendingJob(ctx context.Context, chatId string) (bool, error)
+}
+
+// MessageConsumer hands out queued jobs. A job that is neither completed nor
+// failed is handed out again once the queue considers it abandoned, or with
+// Abandoned set when it was on its last attempt. ExtendJob keeps a job that is
+// still being processed from being considered abandoned. FailJob reports
+// whether the job will be handed out again later.
+type MessageConsumer interface {
+	DequeueUserMessage(ctx context.Context) (MessageJob, error)
+	ExtendJob(ctx context.Context, jobId string) error
+	CompleteJob(ctx context.Context, jobId string) error
+	FailJob(ctx context.Context, jobId string, cause error) (bool, error)
+	PendingJobs(ctx context.Context) (int, error)
+}
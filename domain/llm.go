@@ -5,20 +5,31 @@ import (
 )
 
 type LLMAgent interface {
+	SettingsValidator
+
 	GenerateResponse(
 		ctx context.Context,
 		messages []ChatMessage,
 		tools []LLMTool,
+		settings GenerationSettings,
 	) ([]ChatMessage, error)
 
 	StreamResponse(
 		ctx context.Context,
 		messages []ChatMessage,
 		tools []LLMTool,
+		settings GenerationSettings,
 		callback func(delta string),
 	) ([]ChatMessage, error)
 }
 
+type SettingsValidator interface {
+	// ValidateSettings rejects settings the provider doesn't accept, on top
+	// of the checks of GenerationSettings.Validate, so they're refused when
+	// they're saved instead of when a response is generated.
+	ValidateSettings(settings GenerationSettings) error
+}
+
 type LLMTool interface {
 	Name() string
 	Description() string
@@ -1,6 +1,66 @@
 package domain
 
+import "time"
+
 type PubSub[T any] interface {
-	Subscribe(topic string) (chan T, func(), error)
+	Subscribe(topic string, options SubscribeOptions) (Subscription[T], error)
 	Publish(topic string, message T) error
 }
+
+// BackpressurePolicy decides what happens to a message published while the
+// subscription's buffer is full.
+type BackpressurePolicy string
+
+const (
+	// DropNewest discards the message being published.
+	DropNewest BackpressurePolicy = "drop_newest"
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest BackpressurePolicy = "drop_oldest"
+	// Block waits up to BlockTimeout for room and then discards the message.
+	// The publisher doesn't wait, the messages queue up behind the one
+	// waiting, up to BufferSize of them.
+	Block BackpressurePolicy = "block"
+	// Disconnect closes the subscription.
+	Disconnect BackpressurePolicy = "disconnect"
+)
+
+type SubscribeOptions struct {
+	Policy       BackpressurePolicy
+	BufferSize   int
+	BlockTimeout time.Duration
+	// After resumes the subscription after the event with that ID, replaying
+	// the events published since. Zero only subscribes to new events.
+	After int64
+}
+
+func (o *SubscribeOptions) ApplyDefaults() {
+	if o.Policy == "" {
+		o.Policy = DropNewest
+	}
+
+	if o.BufferSize == 0 {
+		o.BufferSize = 1000
+	}
+
+	if o.BlockTimeout == 0 {
+		o.BlockTimeout = time.Second
+	}
+}
+
+// Event is a published message along with the ID it was given. IDs increase
+// with each message published to a topic.
+type Event[T any] struct {
+	ID      int64
+	Message T
+}
+
+type Subscription[T any] struct {
+	// Messages is closed on Unsubscribe, or when a subscriber with the
+	// Disconnect policy falls behind.
+	Messages <-chan Event[T]
+	// Missed receives a value when messages were discarded, couldn't be
+	// replayed or the subscription was disconnected. Signals that haven't been
+	// read yet are merged into one.
+	Missed      <-chan struct{}
+	Unsubscribe func()
+}
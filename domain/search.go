@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+type SearchParams struct {
+	WorkspaceID string
+	Query       string
+	Role        string
+	From        time.Time
+	To          time.Time
+	Limit       int
+}
+
+func (s *SearchParams) ApplyDefaults() {
+	if s.Limit == 0 {
+		s.Limit = 50
+	}
+}
+
+// SearchResult is either a chat whose name matched the query, when MessageID is
+// nil, or a single message inside that chat.
+type SearchResult struct {
+	ChatSessionID string
+	ChatName      string
+	MessageID     *string
+	Role          *string
+	Snippet       []SnippetPart
+	CreatedAt     time.Time
+}
+
+type SnippetPart struct {
+	Text        string
+	Highlighted bool
+}
+
+type SearchRepository interface {
+	Search(ctx context.Context, params SearchParams) ([]SearchResult, error)
+}
+
+type SearchService interface {
+	Search(ctx context.Context, params SearchParams) ([]SearchResult, error)
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// User is a local account. Users signed up with a password have a
+// PasswordHash, users provisioned by single sign-on have an OIDC identity.
+type User struct {
+	ID           string    `json:"id" db:"id"`
+	Email        string    `json:"email" db:"email"`
+	PasswordHash *string   `json:"-" db:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	OIDCIssuer   *string   `json:"-" db:"oidc_issuer"`
+	OIDCSubject  *string   `json:"-" db:"oidc_subject"`
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("email is already registered")
+	ErrAccessDenied       = errors.New("access denied")
+)
+
+// ExternalIdentity is a user as described by an identity provider, with the
+// claims already mapped to local fields. WorkspaceRoles maps the workspaces
+// whose members follow the provider's groups to the role the user's groups
+// give them there, which is empty when they give none.
+type ExternalIdentity struct {
+	Issuer         string
+	Subject        string
+	Email          string
+	EmailVerified  bool
+	WorkspaceRoles map[string]string
+}
+
+type UserRepository interface {
+	CreateUser(ctx context.Context, email, passwordHash string) (User, error)
+	GetUser(ctx context.Context, userId string) (User, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (User, error)
+	CreateExternalUser(ctx context.Context, identity ExternalIdentity) (User, error)
+	// UpdateExternalUser links the user to the identity and syncs its
+	// email.
+	UpdateExternalUser(ctx context.Context, userId string, identity ExternalIdentity) (User, error)
+	// SyncWorkspaceRoles sets the user's role in each of the workspaces,
+	// removing them from those where the role is empty.
+	SyncWorkspaceRoles(ctx context.Context, userId string, roles map[string]string) error
+	CreateSession(ctx context.Context, tokenHash, userId string, ttl time.Duration) error
+	GetSessionUser(ctx context.Context, tokenHash string) (User, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+}
+
+// UserSession is a signed in session, identified by Token.
+type UserSession struct {
+	User      User
+	Token     string
+	ExpiresAt time.Time
+}
+
+// AuthService signs users in with a password or an external identity. Signup,
+// Login and LoginExternal start a new session, whose token Authenticate
+// resolves back to its user.
+type AuthService interface {
+	Signup(ctx context.Context, email, password string) (UserSession, error)
+	Login(ctx context.Context, email, password string) (UserSession, error)
+	LoginExternal(ctx context.Context, identity ExternalIdentity) (UserSession, error)
+	Logout(ctx context.Context, token string) error
+	Authenticate(ctx context.Context, token string) (User, error)
+}
+
+type userContextKey struct{}
+
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFromContext returns the user the request was authenticated as.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(User)
+	return user, ok
+}
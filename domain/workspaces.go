@@ -0,0 +1,92 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Workspace groups the chats a team shares. Every chat belongs to one and its
+// members can reach it according to their role.
+type Workspace struct {
+	ID        string    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+const (
+	WorkspaceOwner  = "owner"
+	WorkspaceEditor = "editor"
+	WorkspaceViewer = "viewer"
+)
+
+// WorkspaceRoles lists the roles from the most to the least privileged. Owners
+// manage the members and delete chats, editors write to chats and viewers
+// only read them.
+var WorkspaceRoles = []string{WorkspaceOwner, WorkspaceEditor, WorkspaceViewer}
+
+var ErrLastOwner = errors.New("a workspace needs at least one owner")
+
+// WorkspaceMembership is a workspace as seen by one of its members.
+type WorkspaceMembership struct {
+	Workspace
+	Role string `json:"role" db:"role"`
+}
+
+// Allows reports whether the member's role is at least as privileged as role.
+func (m WorkspaceMembership) Allows(role string) bool {
+	have := slices.Index(WorkspaceRoles, m.Role)
+	return have != -1 && have <= slices.Index(WorkspaceRoles, role)
+}
+
+type WorkspaceMember struct {
+	UserID    string    `json:"user_id" db:"user_id"`
+	Email     string    `json:"email" db:"email"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type WorkspaceRepository interface {
+	// CreateWorkspace creates a workspace owned by the user.
+	CreateWorkspace(ctx context.Context, userId, name string) (WorkspaceMembership, error)
+	ListWorkspaces(ctx context.Context, userId string) ([]WorkspaceMembership, error)
+	GetMembership(ctx context.Context, workspaceId, userId string) (WorkspaceMembership, error)
+	ListMembers(ctx context.Context, workspaceId string) ([]WorkspaceMember, error)
+	// AddMember adds the user registered with the email. It returns
+	// ErrNotFound when there's no such user or they're already a member.
+	AddMember(ctx context.Context, workspaceId, email, role string) (WorkspaceMember, error)
+	UpdateMember(ctx context.Context, workspaceId, userId, role string) error
+	RemoveMember(ctx context.Context, workspaceId, userId string) error
+}
+
+// WorkspaceService manages workspaces on behalf of userId, returning
+// ErrNotFound for workspaces they aren't a member of and ErrAccessDenied when
+// their role doesn't allow the change.
+type WorkspaceService interface {
+	ListWorkspaces(ctx context.Context, userId string) ([]WorkspaceMembership, error)
+	CreateWorkspace(ctx context.Context, userId, name string) (WorkspaceMembership, error)
+	GetMembership(ctx context.Context, workspaceId, userId string) (WorkspaceMembership, error)
+	// CurrentWorkspace returns the workspace the user is working in, which is
+	// workspaceId if they're still a member of it and otherwise their oldest
+	// workspace, created on the spot for users without one.
+	CurrentWorkspace(ctx context.Context, userId, workspaceId string) (WorkspaceMembership, error)
+	ListMembers(ctx context.Context, userId, workspaceId string) ([]WorkspaceMember, error)
+	AddMember(ctx context.Context, userId, workspaceId, email, role string) (WorkspaceMember, error)
+	UpdateMember(ctx context.Context, userId, workspaceId, memberId, role string) error
+	// RemoveMember lets owners remove anyone and other members leave.
+	RemoveMember(ctx context.Context, userId, workspaceId, memberId string) error
+}
+
+type workspaceContextKey struct{}
+
+func WithWorkspace(ctx context.Context, membership WorkspaceMembership) context.Context {
+	return context.WithValue(ctx, workspaceContextKey{}, membership)
+}
+
+// WorkspaceFromContext returns the workspace the request acts in, along with
+// the role the user has there.
+func WorkspaceFromContext(ctx context.Context) (WorkspaceMembership, bool) {
+	membership, ok := ctx.Value(workspaceContextKey{}).(WorkspaceMembership)
+	return membership, ok
+}
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE chats
+ADD COLUMN model VARCHAR(255) NOT NULL DEFAULT '',
+ADD COLUMN temperature DOUBLE PRECISION,
+ADD COLUMN top_p DOUBLE PRECISION,
+ADD COLUMN max_output_tokens BIGINT,
+ADD COLUMN reasoning_effort VARCHAR(50) NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE chats
+DROP COLUMN IF EXISTS model,
+DROP COLUMN IF EXISTS temperature,
+DROP COLUMN IF EXISTS top_p,
+DROP COLUMN IF EXISTS max_output_tokens,
+DROP COLUMN IF EXISTS reasoning_effort;
+
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE chats
+ADD COLUMN system_prompt TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE chats
+DROP COLUMN IF EXISTS system_prompt;
+
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE chat_messages
+ADD COLUMN seq BIGSERIAL;
+
+CREATE INDEX idx_chat_messages_session_order ON chat_messages (chat_session_id, created_at, seq);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_chat_messages_session_order;
+
+ALTER TABLE chat_messages
+DROP COLUMN IF EXISTS seq;
+
+-- +goose StatementEnd
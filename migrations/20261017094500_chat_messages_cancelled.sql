@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE chat_messages
+ADD COLUMN cancelled BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE chat_messages
+DROP COLUMN IF EXISTS cancelled;
+
+-- +goose StatementEnd
@@ -0,0 +1,44 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE chat_messages
+ADD COLUMN parent_id UUID REFERENCES chat_messages (id) ON DELETE CASCADE;
+
+ALTER TABLE chats
+ADD COLUMN current_leaf_id UUID;
+
+UPDATE chat_messages m
+SET parent_id = ordered.prev_id
+FROM (
+  SELECT
+    id,
+    LAG (id) OVER (
+      PARTITION BY chat_session_id
+      ORDER BY created_at, seq
+    ) AS prev_id
+  FROM chat_messages
+) ordered
+WHERE m.id = ordered.id;
+
+UPDATE chats c
+SET current_leaf_id = (
+  SELECT m.id
+  FROM chat_messages m
+  WHERE m.chat_session_id = c.id
+  ORDER BY m.created_at DESC, m.seq DESC
+  LIMIT 1
+);
+
+CREATE INDEX idx_chat_messages_parent ON chat_messages (parent_id);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_chat_messages_parent;
+
+ALTER TABLE chats
+DROP COLUMN IF EXISTS current_leaf_id;
+
+ALTER TABLE chat_messages
+DROP COLUMN IF EXISTS parent_id;
+
+-- +goose StatementEnd
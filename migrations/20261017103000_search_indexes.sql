@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX idx_chats_name_search ON chats USING GIN (to_tsvector('english', name));
+
+CREATE INDEX idx_chat_messages_content_search ON chat_messages USING GIN (to_tsvector('english', content));
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_chat_messages_content_search;
+
+DROP INDEX IF EXISTS idx_chats_name_search;
+
+-- +goose StatementEnd
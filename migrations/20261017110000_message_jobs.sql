@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  IF NOT EXISTS message_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+    chat_session_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+    message_id UUID NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    visible_at TIMESTAMP NOT NULL DEFAULT NOW (),
+    failed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+CREATE INDEX idx_message_jobs_pending ON message_jobs (visible_at, created_at)
+WHERE
+  failed_at IS NULL;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS message_jobs;
+
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  IF NOT EXISTS pubsub_payloads (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+CREATE INDEX idx_pubsub_payloads_created_at ON pubsub_payloads (created_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS pubsub_payloads;
+
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE IF NOT EXISTS pubsub_event_ids;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP SEQUENCE IF EXISTS pubsub_event_ids;
+
+-- +goose StatementEnd
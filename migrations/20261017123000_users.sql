@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+    email VARCHAR(255) NOT NULL UNIQUE,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+CREATE TABLE
+  IF NOT EXISTS user_sessions (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+CREATE INDEX idx_user_sessions_expires_at ON user_sessions (expires_at);
+
+-- Chats created before accounts existed have no owner and are only
+-- reachable from the database. Chats outlive their author, the rest of their
+-- workspace may still be using them.
+ALTER TABLE chats
+ADD COLUMN user_id UUID REFERENCES users (id) ON DELETE SET NULL;
+
+CREATE INDEX idx_chats_user_id ON chats (user_id, created_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE chats
+DROP COLUMN IF EXISTS user_id;
+
+DROP TABLE IF EXISTS user_sessions;
+
+DROP TABLE IF EXISTS users;
+
+-- +goose StatementEnd
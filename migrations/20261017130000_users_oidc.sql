@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ALTER COLUMN password_hash
+DROP NOT NULL,
+ADD COLUMN oidc_issuer VARCHAR(255),
+ADD COLUMN oidc_subject VARCHAR(255);
+
+CREATE UNIQUE INDEX idx_users_oidc_identity ON users (oidc_issuer, oidc_subject);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_users_oidc_identity;
+
+-- Users created by single sign-on have no password and can't be kept.
+DELETE FROM users
+WHERE
+  password_hash IS NULL;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS oidc_subject,
+DROP COLUMN IF EXISTS oidc_issuer,
+ALTER COLUMN password_hash
+SET NOT NULL;
+
+-- +goose StatementEnd
@@ -0,0 +1,73 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  IF NOT EXISTS workspaces (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+CREATE TABLE
+  IF NOT EXISTS workspace_members (
+    workspace_id UUID NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+    PRIMARY KEY (workspace_id, user_id)
+  );
+
+CREATE INDEX idx_workspace_members_user_id ON workspace_members (user_id, created_at);
+
+-- user_id is kept as the chat's author, access goes through the workspace.
+ALTER TABLE chats
+ADD COLUMN workspace_id UUID REFERENCES workspaces (id) ON DELETE CASCADE;
+
+CREATE INDEX idx_chats_workspace_id ON chats (workspace_id, created_at);
+
+-- Existing users get a personal workspace holding the chats they own.
+WITH
+  personal AS (
+    SELECT
+      id AS user_id,
+      gen_random_uuid () AS workspace_id
+    FROM
+      users
+  ),
+  created_workspaces AS (
+    INSERT INTO
+      workspaces (id, name)
+    SELECT
+      workspace_id,
+      'Personal'
+    FROM
+      personal
+  ),
+  created_members AS (
+    INSERT INTO
+      workspace_members (workspace_id, user_id, role)
+    SELECT
+      workspace_id,
+      user_id,
+      'owner'
+    FROM
+      personal
+  )
+UPDATE chats
+SET
+  workspace_id = personal.workspace_id
+FROM
+  personal
+WHERE
+  chats.user_id = personal.user_id;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE chats
+DROP COLUMN IF EXISTS workspace_id;
+
+DROP TABLE IF EXISTS workspace_members;
+
+DROP TABLE IF EXISTS workspaces;
+
+-- +goose StatementEnd
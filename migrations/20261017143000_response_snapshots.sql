@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  IF NOT EXISTS response_snapshots (
+    chat_session_id UUID PRIMARY KEY REFERENCES chats (id) ON DELETE CASCADE,
+    delta_id TEXT NOT NULL,
+    text TEXT NOT NULL DEFAULT '',
+    seq INT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW ()
+  );
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS response_snapshots;
+
+-- +goose StatementEnd
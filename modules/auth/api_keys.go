@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+const (
+	apiKeyPrefix = "htb_"
+	// apiKeyPrefixLength is how much of a key is stored in clear, enough to
+	// recognize it in the settings page.
+	apiKeyPrefixLength = len(apiKeyPrefix) + 6
+)
+
+var _ domain.APIKeyService = &APIKeys{}
+
+type APIKeys struct {
+	repository domain.APIKeyRepository
+	users      domain.UserRepository
+}
+
+func NewAPIKeys(repository domain.APIKeyRepository, users domain.UserRepository) *APIKeys {
+	return &APIKeys{
+		repository: repository,
+		users:      users,
+	}
+}
+
+func (a *APIKeys) CreateAPIKey(
+	ctx context.Context,
+	userId, name string,
+	scopes []string,
+) (domain.APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return domain.APIKey{}, "", fmt.Errorf("name is required")
+	}
+
+	if len(scopes) == 0 {
+		return domain.APIKey{}, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(domain.Scopes, scope) {
+			return domain.APIKey{}, "", fmt.Errorf("invalid scope: %s", scope)
+		}
+	}
+
+	secret := apiKeyPrefix + rand.Text()
+	key, err := a.repository.CreateAPIKey(
+		ctx,
+		userId,
+		name,
+		secret[:apiKeyPrefixLength],
+		hashToken(secret),
+		scopes,
+	)
+	if err != nil {
+		return domain.APIKey{}, "", err
+	}
+
+	return key, secret, nil
+}
+
+func (a *APIKeys) ListAPIKeys(ctx context.Context, userId string) ([]domain.APIKey, error) {
+	return a.repository.ListAPIKeys(ctx, userId)
+}
+
+func (a *APIKeys) RevokeAPIKey(ctx context.Context, userId, keyId string) error {
+	return a.repository.DeleteAPIKey(ctx, userId, keyId)
+}
+
+func (a *APIKeys) AuthenticateAPIKey(ctx context.Context, secret string) (domain.User, domain.APIKey, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return domain.User{}, domain.APIKey{}, domain.ErrInvalidCredentials
+	}
+
+	key, err := a.repository.GetAPIKey(ctx, hashToken(secret))
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.User{}, domain.APIKey{}, domain.ErrInvalidCredentials
+	}
+	if err != nil {
+		return domain.User{}, domain.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	user, err := a.users.GetUser(ctx, key.UserID)
+	if err != nil {
+		return domain.User{}, domain.APIKey{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// A failure to record the use shouldn't fail the request.
+	if err := a.repository.TouchAPIKey(ctx, key.ID); err != nil {
+		log.Errorf("failed to record api key use: %v", err)
+	}
+
+	return user, key, nil
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	authviews "github.com/raphael-foliveira/htmbot/modules/auth/views"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+func (h *Handler) apiKeysPage(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	keys, err := h.apiKeys.ListAPIKeys(c.Request().Context(), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list api keys: %w", err)
+	}
+
+	return httpx.Render(c, authviews.APIKeysPage(keys))
+}
+
+func (h *Handler) createAPIKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, _ := domain.UserFromContext(ctx)
+
+	form, err := c.FormParams()
+	if err != nil {
+		return fmt.Errorf("failed to parse form: %w", err)
+	}
+
+	_, secret, createErr := h.apiKeys.CreateAPIKey(ctx, user.ID, form.Get("name"), form["scopes"])
+
+	keys, err := h.apiKeys.ListAPIKeys(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list api keys: %w", err)
+	}
+
+	return httpx.Render(c, authviews.APIKeys(keys, secret, createErr))
+}
+
+func (h *Handler) revokeAPIKey(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	if err := h.apiKeys.RevokeAPIKey(c.Request().Context(), user.ID, c.Param("key-id")); err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	// An empty 200 response makes htmx remove the key's row.
+	return c.NoContent(http.StatusOK)
+}
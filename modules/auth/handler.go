@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	authviews "github.com/raphael-foliveira/htmbot/modules/auth/views"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+const sessionCookie = "session"
+
+type HandlerConfig struct {
+	// InsecureCookies lets the session cookie be sent over plain HTTP, for
+	// local development.
+	InsecureCookies bool
+	// DisablePasswords turns off signup and password logins, leaving single
+	// sign-on as the only way in.
+	DisablePasswords bool
+}
+
+type Handler struct {
+	service domain.AuthService
+	apiKeys domain.APIKeyService
+	oidc    *OIDC
+	config  HandlerConfig
+}
+
+// NewHandler creates the auth handler. Single sign-on is enabled when oidc
+// isn't nil.
+func NewHandler(
+	service domain.AuthService,
+	apiKeys domain.APIKeyService,
+	oidc *OIDC,
+	config HandlerConfig,
+) *Handler {
+	return &Handler{
+		service: service,
+		apiKeys: apiKeys,
+		oidc:    oidc,
+		config:  config,
+	}
+}
+
+func (h *Handler) Register(e *echo.Echo) {
+	e.GET("/login", h.loginPage)
+	e.POST("/logout", h.logout)
+
+	if !h.config.DisablePasswords {
+		e.POST("/login", h.login)
+		e.GET("/signup", h.signupPage)
+		e.POST("/signup", h.signup)
+	}
+
+	if h.oidc != nil {
+		e.GET("/auth/oidc/login", h.oidcLogin)
+		e.GET("/auth/oidc/callback", h.oidcCallback)
+	}
+
+	kg := e.Group("/settings/api-keys", h.RequireUser, requireSession)
+	kg.GET("", h.apiKeysPage)
+	kg.POST("", h.createAPIKey)
+	kg.DELETE("/:key-id", h.revokeAPIKey)
+}
+
+func (h *Handler) loginPage(c echo.Context) error {
+	return h.renderLoginPage(c, nil)
+}
+
+func (h *Handler) renderLoginPage(c echo.Context, err error) error {
+	return httpx.Render(c, authviews.Login(!h.config.DisablePasswords, h.oidc != nil, err))
+}
+
+func (h *Handler) signupPage(c echo.Context) error {
+	return httpx.Render(c, authviews.Signup())
+}
+
+func (h *Handler) login(c echo.Context) error {
+	email := c.FormValue("email")
+
+	session, err := h.service.Login(c.Request().Context(), email, c.FormValue("password"))
+	if errors.Is(err, domain.ErrInvalidCredentials) {
+		return httpx.Render(c, authviews.LoginForm(email, err))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+
+	h.setSessionCookie(c, session.Token, session.ExpiresAt)
+	return httpx.HxRedirect(c, "/chat")
+}
+
+func (h *Handler) signup(c echo.Context) error {
+	email := c.FormValue("email")
+
+	session, err := h.service.Signup(c.Request().Context(), email, c.FormValue("password"))
+	if err != nil {
+		return httpx.Render(c, authviews.SignupForm(email, err))
+	}
+
+	h.setSessionCookie(c, session.Token, session.ExpiresAt)
+	return httpx.HxRedirect(c, "/chat")
+}
+
+func (h *Handler) logout(c echo.Context) error {
+	if cookie, err := c.Cookie(sessionCookie); err == nil {
+		if err := h.service.Logout(c.Request().Context(), cookie.Value); err != nil {
+			return fmt.Errorf("failed to log out: %w", err)
+		}
+	}
+
+	h.setSessionCookie(c, "", time.Unix(0, 0))
+	return httpx.HxRedirect(c, "/login")
+}
+
+func (h *Handler) setSessionCookie(c echo.Context, token string, expires time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   !h.config.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+// RequireUser lets through requests with a valid session or API key and
+// sends the rest to the login page.
+func (h *Handler) RequireUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return h.requireUser(next, func(c echo.Context) error {
+		if c.Request().Header.Get("HX-Request") == "true" {
+			return httpx.HxRedirect(c, "/login")
+		}
+		return c.Redirect(http.StatusFound, "/login")
+	})
+}
+
+// RequireAPIUser is RequireUser for API routes, which answer 401 instead of
+// redirecting.
+func (h *Handler) RequireAPIUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return h.requireUser(next, func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	})
+}
+
+// requireUser stores the authenticated user in the request context, where
+// handlers get it with domain.UserFromContext. Requests with an Authorization
+// header are authenticated with the API key it carries, never with the
+// session cookie.
+func (h *Handler) requireUser(next, unauthenticated echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if header := c.Request().Header.Get("Authorization"); header != "" {
+			secret, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized, "unsupported authorization scheme")
+			}
+
+			user, key, err := h.apiKeys.AuthenticateAPIKey(ctx, secret)
+			if errors.Is(err, domain.ErrInvalidCredentials) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid api key")
+			}
+			if err != nil {
+				return fmt.Errorf("failed to authenticate api key: %w", err)
+			}
+
+			c.SetRequest(c.Request().WithContext(domain.WithAPIKey(domain.WithUser(ctx, user), key)))
+			return next(c)
+		}
+
+		cookie, err := c.Cookie(sessionCookie)
+		if err != nil {
+			return unauthenticated(c)
+		}
+
+		user, err := h.service.Authenticate(ctx, cookie.Value)
+		if errors.Is(err, domain.ErrInvalidCredentials) {
+			return unauthenticated(c)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+
+		c.SetRequest(c.Request().WithContext(domain.WithUser(ctx, user)))
+		return next(c)
+	}
+}
+
+// requireSession keeps API keys out of routes that manage the account.
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := domain.APIKeyFromContext(c.Request().Context()); ok {
+			return echo.NewHTTPError(http.StatusForbidden, "api keys can't manage the account")
+		}
+		return next(c)
+	}
+}
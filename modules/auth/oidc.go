@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// EmailClaim and GroupsClaim name the claims of the ID token the user is
+	// mapped from. Nested claims are reached with dots, as in
+	// "realm_access.roles".
+	EmailClaim  string
+	GroupsClaim string
+	// AllowedGroups restricts sign-in to the users in at least one of the
+	// groups. When it's empty, every user of the provider can sign in.
+	AllowedGroups []string
+	// GroupRoles gives the users in groups a role in workspaces. The members
+	// of those workspaces follow the groups, users are added, updated or
+	// removed as they sign in. A user in several groups mapped to the same
+	// workspace gets the most privileged of their roles.
+	GroupRoles []GroupRole
+}
+
+// GroupRole gives the users in Group the Role in the workspace.
+type GroupRole struct {
+	Group       string
+	WorkspaceID string
+	Role        string
+}
+
+func (c *OIDCConfig) ApplyDefaults() {
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	if c.EmailClaim == "" {
+		c.EmailClaim = "email"
+	}
+
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+}
+
+func (c *OIDCConfig) Validate() error {
+	for _, groupRole := range c.GroupRoles {
+		if err := uuid.Validate(groupRole.WorkspaceID); err != nil {
+			return fmt.Errorf("invalid workspace for group %s: %s", groupRole.Group, groupRole.WorkspaceID)
+		}
+		if !slices.Contains(domain.WorkspaceRoles, groupRole.Role) {
+			return fmt.Errorf("invalid role for group %s: %s", groupRole.Group, groupRole.Role)
+		}
+	}
+
+	return nil
+}
+
+// OIDC signs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE.
+type OIDC struct {
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	config   OIDCConfig
+}
+
+// NewOIDC discovers the provider's endpoints from its issuer URL.
+func NewOIDC(ctx context.Context, config OIDCConfig) (*OIDC, error) {
+	config.ApplyDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover provider: %w", err)
+	}
+
+	return &OIDC{
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       config.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		config:   config,
+	}, nil
+}
+
+func (o *OIDC) AuthCodeURL(state, verifier, nonce string) string {
+	return o.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+}
+
+// Exchange redeems the authorization code and maps the claims of the ID
+// token to an identity.
+func (o *OIDC) Exchange(ctx context.Context, code, verifier, nonce string) (domain.ExternalIdentity, error) {
+	token, err := o.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return domain.ExternalIdentity{}, fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return domain.ExternalIdentity{}, fmt.Errorf("token response has no id_token")
+	}
+
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return domain.ExternalIdentity{}, fmt.Errorf("failed to verify id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return domain.ExternalIdentity{}, fmt.Errorf("id_token nonce doesn't match")
+	}
+
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return domain.ExternalIdentity{}, fmt.Errorf("failed to parse claims: %w", err)
+	}
+
+	email, _ := claim(claims, o.config.EmailClaim).(string)
+	if email == "" {
+		return domain.ExternalIdentity{}, fmt.Errorf("id_token has no %s claim", o.config.EmailClaim)
+	}
+
+	groups := claimStrings(claim(claims, o.config.GroupsClaim))
+	if !o.allowed(groups) {
+		return domain.ExternalIdentity{}, domain.ErrAccessDenied
+	}
+
+	return domain.ExternalIdentity{
+		Issuer:         idToken.Issuer,
+		Subject:        idToken.Subject,
+		Email:          email,
+		EmailVerified:  claim(claims, "email_verified") == true,
+		WorkspaceRoles: o.workspaceRoles(groups),
+	}, nil
+}
+
+func (o *OIDC) allowed(groups []string) bool {
+	if len(o.config.AllowedGroups) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(groups, func(group string) bool {
+		return slices.Contains(o.config.AllowedGroups, group)
+	})
+}
+
+// workspaceRoles returns the role the groups give in each mapped workspace,
+// leaving it empty in those none of the groups are mapped to.
+func (o *OIDC) workspaceRoles(groups []string) map[string]string {
+	roles := map[string]string{}
+	for _, groupRole := range o.config.GroupRoles {
+		role := roles[groupRole.WorkspaceID]
+		if slices.Contains(groups, groupRole.Group) &&
+			(role == "" || (domain.WorkspaceMembership{Role: groupRole.Role}).Allows(role)) {
+			role = groupRole.Role
+		}
+		roles[groupRole.WorkspaceID] = role
+	}
+	return roles
+}
+
+func claim(claims map[string]any, path string) any {
+	var value any = claims
+	for key := range strings.SplitSeq(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// claimStrings reads a claim holding either a list of strings or a single
+// one.
+func claimStrings(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, item := range value {
+			if item, ok := item.(string); ok {
+				values = append(values, item)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcFlowCookie = "oidc_flow"
+	oidcFlowMaxAge = 10 * 60
+)
+
+// oidcLogin starts the authorization code flow. The state, PKCE verifier and
+// nonce are kept in a short-lived cookie until the provider redirects back.
+func (h *Handler) oidcLogin(c echo.Context) error {
+	state, verifier, nonce := rand.Text(), oauth2.GenerateVerifier(), rand.Text()
+
+	h.setFlowCookie(c, strings.Join([]string{state, verifier, nonce}, "."), oidcFlowMaxAge)
+	return c.Redirect(http.StatusFound, h.oidc.AuthCodeURL(state, verifier, nonce))
+}
+
+func (h *Handler) oidcCallback(c echo.Context) error {
+	cookie, err := c.Cookie(oidcFlowCookie)
+	if err != nil {
+		return h.renderLoginPage(c, fmt.Errorf("sign-in expired, please try again"))
+	}
+	h.setFlowCookie(c, "", -1)
+
+	flow := strings.Split(cookie.Value, ".")
+	if len(flow) != 3 || c.QueryParam("state") != flow[0] {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid state")
+	}
+	verifier, nonce := flow[1], flow[2]
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		log.Errorf("identity provider returned an error: %s: %s", providerError, c.QueryParam("error_description"))
+		return h.renderLoginPage(c, domain.ErrAccessDenied)
+	}
+
+	identity, err := h.oidc.Exchange(c.Request().Context(), c.QueryParam("code"), verifier, nonce)
+	if errors.Is(err, domain.ErrAccessDenied) {
+		return h.renderLoginPage(c, err)
+	}
+	if err != nil {
+		log.Errorf("failed to sign in with the identity provider: %v", err)
+		return h.renderLoginPage(c, fmt.Errorf("sign-in failed, please try again"))
+	}
+
+	session, err := h.service.LoginExternal(c.Request().Context(), identity)
+	if errors.Is(err, domain.ErrEmailTaken) {
+		return h.renderLoginPage(c, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+
+	h.setSessionCookie(c, session.Token, session.ExpiresAt)
+	return c.Redirect(http.StatusFound, "/chat")
+}
+
+func (h *Handler) setFlowCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !h.config.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
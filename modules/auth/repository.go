@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+const uniqueViolation = "23505"
+
+var (
+	_ domain.UserRepository   = &PGXRepository{}
+	_ domain.APIKeyRepository = &PGXRepository{}
+)
+
+type PGXRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPGXRepository(pool *pgxpool.Pool) *PGXRepository {
+	return &PGXRepository{
+		pool: pool,
+	}
+}
+
+const createUserQuery = `
+INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING *;
+`
+
+func (p *PGXRepository) CreateUser(ctx context.Context, email, passwordHash string) (domain.User, error) {
+	rows, err := p.pool.Query(ctx, createUserQuery, email, passwordHash)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	user, err := collectUser(rows)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return user, nil
+}
+
+const getUserByIdentityQuery = `
+SELECT *
+FROM users
+WHERE oidc_issuer = $1 AND oidc_subject = $2;
+`
+
+func (p *PGXRepository) GetUserByIdentity(ctx context.Context, issuer, subject string) (domain.User, error) {
+	rows, err := p.pool.Query(ctx, getUserByIdentityQuery, issuer, subject)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return collectUser(rows)
+}
+
+const createExternalUserQuery = `
+INSERT INTO users (email, oidc_issuer, oidc_subject)
+VALUES ($1, $2, $3)
+RETURNING *;
+`
+
+func (p *PGXRepository) CreateExternalUser(ctx context.Context, identity domain.ExternalIdentity) (domain.User, error) {
+	rows, err := p.pool.Query(
+		ctx,
+		createExternalUserQuery,
+		identity.Email,
+		identity.Issuer,
+		identity.Subject,
+	)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	user, err := collectUser(rows)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return user, nil
+}
+
+const updateExternalUserQuery = `
+UPDATE users
+SET email = $2, oidc_issuer = $3, oidc_subject = $4
+WHERE id = $1
+RETURNING *;
+`
+
+func (p *PGXRepository) UpdateExternalUser(
+	ctx context.Context,
+	userId string,
+	identity domain.ExternalIdentity,
+) (domain.User, error) {
+	rows, err := p.pool.Query(
+		ctx,
+		updateExternalUserQuery,
+		userId,
+		identity.Email,
+		identity.Issuer,
+		identity.Subject,
+	)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to update user: %w", err)
+	}
+
+	user, err := collectUser(rows)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to update user: %w", err)
+	}
+
+	return user, nil
+}
+
+// syncWorkspaceRolesQuery takes the workspaces and roles as two arrays of the
+// same length. Workspaces that no longer exist are skipped.
+const syncWorkspaceRolesQuery = `
+WITH roles AS (
+	SELECT r.workspace_id::uuid AS workspace_id, r.role
+	FROM unnest($2::text[], $3::text[]) AS r (workspace_id, role)
+),
+removed AS (
+	DELETE FROM workspace_members m
+	USING roles
+	WHERE m.user_id = $1 AND m.workspace_id = roles.workspace_id AND roles.role = ''
+)
+INSERT INTO workspace_members (workspace_id, user_id, role)
+SELECT roles.workspace_id, $1, roles.role
+FROM roles
+JOIN workspaces w ON w.id = roles.workspace_id
+WHERE roles.role <> ''
+ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role;
+`
+
+func (p *PGXRepository) SyncWorkspaceRoles(ctx context.Context, userId string, roles map[string]string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+
+	workspaceIds, workspaceRoles := []string{}, []string{}
+	for workspaceId, role := range roles {
+		workspaceIds = append(workspaceIds, workspaceId)
+		workspaceRoles = append(workspaceRoles, role)
+	}
+
+	if _, err := p.pool.Exec(ctx, syncWorkspaceRolesQuery, userId, workspaceIds, workspaceRoles); err != nil {
+		return fmt.Errorf("failed to sync workspace roles: %w", err)
+	}
+	return nil
+}
+
+const getUserQuery = `
+SELECT *
+FROM users
+WHERE id = $1;
+`
+
+func (p *PGXRepository) GetUser(ctx context.Context, userId string) (domain.User, error) {
+	rows, err := p.pool.Query(ctx, getUserQuery, userId)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return collectUser(rows)
+}
+
+const getUserByEmailQuery = `
+SELECT *
+FROM users
+WHERE email = $1;
+`
+
+func (p *PGXRepository) GetUserByEmail(ctx context.Context, email string) (domain.User, error) {
+	rows, err := p.pool.Query(ctx, getUserByEmailQuery, email)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return collectUser(rows)
+}
+
+// Expired sessions are cleaned up whenever a new one is created.
+const createSessionQuery = `
+WITH expired AS (
+	DELETE FROM user_sessions WHERE expires_at < NOW()
+)
+INSERT INTO user_sessions (token_hash, user_id, expires_at)
+VALUES ($1, $2, NOW() + make_interval(secs => $3::float8));
+`
+
+func (p *PGXRepository) CreateSession(ctx context.Context, tokenHash, userId string, ttl time.Duration) error {
+	if _, err := p.pool.Exec(ctx, createSessionQuery, tokenHash, userId, ttl.Seconds()); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+const getSessionUserQuery = `
+SELECT u.*
+FROM user_sessions s
+JOIN users u ON u.id = s.user_id
+WHERE s.token_hash = $1
+AND s.expires_at > NOW();
+`
+
+func (p *PGXRepository) GetSessionUser(ctx context.Context, tokenHash string) (domain.User, error) {
+	rows, err := p.pool.Query(ctx, getSessionUserQuery, tokenHash)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	return collectUser(rows)
+}
+
+const deleteSessionQuery = `
+DELETE FROM user_sessions WHERE token_hash = $1;
+`
+
+func (p *PGXRepository) DeleteSession(ctx context.Context, tokenHash string) error {
+	if _, err := p.pool.Exec(ctx, deleteSessionQuery, tokenHash); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+const createAPIKeyQuery = `
+INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+`
+
+func (p *PGXRepository) CreateAPIKey(
+	ctx context.Context,
+	userId, name, prefix, keyHash string,
+	scopes []string,
+) (domain.APIKey, error) {
+	rows, err := p.pool.Query(ctx, createAPIKeyQuery, userId, name, prefix, keyHash, scopes)
+	if err != nil {
+		return domain.APIKey{}, fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.APIKey])
+}
+
+const listAPIKeysQuery = `
+SELECT *
+FROM api_keys
+WHERE user_id = $1
+ORDER BY created_at;
+`
+
+func (p *PGXRepository) ListAPIKeys(ctx context.Context, userId string) ([]domain.APIKey, error) {
+	rows, err := p.pool.Query(ctx, listAPIKeysQuery, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[domain.APIKey])
+}
+
+const getAPIKeyQuery = `
+SELECT *
+FROM api_keys
+WHERE key_hash = $1;
+`
+
+func (p *PGXRepository) GetAPIKey(ctx context.Context, keyHash string) (domain.APIKey, error) {
+	rows, err := p.pool.Query(ctx, getAPIKeyQuery, keyHash)
+	if err != nil {
+		return domain.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	key, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.APIKey])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.APIKey{}, fmt.Errorf("api key: %w", domain.ErrNotFound)
+	}
+	return key, err
+}
+
+const deleteAPIKeyQuery = `
+DELETE FROM api_keys WHERE id = $1 AND user_id = $2;
+`
+
+func (p *PGXRepository) DeleteAPIKey(ctx context.Context, userId, keyId string) error {
+	tag, err := p.pool.Exec(ctx, deleteAPIKeyQuery, keyId, userId)
+	if err != nil {
+		return fmt.Errorf("failed to delete api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("api key %s: %w", keyId, domain.ErrNotFound)
+	}
+	return nil
+}
+
+// The last use is recorded with a minute's precision, so a busy key doesn't
+// write on every request.
+const touchAPIKeyQuery = `
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE id = $1
+AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute');
+`
+
+func (p *PGXRepository) TouchAPIKey(ctx context.Context, keyId string) error {
+	if _, err := p.pool.Exec(ctx, touchAPIKeyQuery, keyId); err != nil {
+		return fmt.Errorf("failed to update api key: %w", err)
+	}
+	return nil
+}
+
+func collectUser(rows pgx.Rows) (domain.User, error) {
+	user, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.User])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.User{}, fmt.Errorf("user: %w", domain.ErrNotFound)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return domain.User{}, domain.ErrEmailTaken
+	}
+
+	return user, err
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt only uses the first 72 bytes of a password.
+	maxPasswordLength = 72
+)
+
+var _ domain.AuthService = &Service{}
+
+type ServiceConfig struct {
+	SessionTTL time.Duration
+	// ExternalSessionTTL is how long single sign-on sessions last. The
+	// provider is only asked about the user when they sign in, so a short
+	// session makes losing access there, e.g. by leaving an allowed group,
+	// take effect soon. Signing in again usually goes straight through the
+	// provider's own session.
+	ExternalSessionTTL time.Duration
+}
+
+func (c *ServiceConfig) ApplyDefaults() {
+	if c.SessionTTL == 0 {
+		c.SessionTTL = 30 * 24 * time.Hour
+	}
+
+	if c.ExternalSessionTTL == 0 {
+		c.ExternalSessionTTL = 8 * time.Hour
+	}
+}
+
+type Service struct {
+	repository domain.UserRepository
+	config     ServiceConfig
+	// dummyHash is compared against when the email is unknown, so a login
+	// takes as long whether or not the account exists.
+	dummyHash []byte
+}
+
+func NewService(repository domain.UserRepository, config ServiceConfig) *Service {
+	config.ApplyDefaults()
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return &Service{
+		repository: repository,
+		config:     config,
+		dummyHash:  dummyHash,
+	}
+}
+
+func (s *Service) Signup(ctx context.Context, email, password string) (domain.UserSession, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return domain.UserSession{}, err
+	}
+
+	if len(password) < minPasswordLength {
+		return domain.UserSession{}, fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return domain.UserSession{}, fmt.Errorf("password must be at most %d bytes long", maxPasswordLength)
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return domain.UserSession{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user, err := s.repository.CreateUser(ctx, email, string(passwordHash))
+	if err != nil {
+		return domain.UserSession{}, err
+	}
+
+	return s.createSession(ctx, user, s.config.SessionTTL)
+}
+
+func (s *Service) Login(ctx context.Context, email, password string) (domain.UserSession, error) {
+	user, err := s.repository.GetUserByEmail(ctx, strings.ToLower(strings.TrimSpace(email)))
+	if errors.Is(err, domain.ErrNotFound) {
+		bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+		return domain.UserSession{}, domain.ErrInvalidCredentials
+	}
+	if err != nil {
+		return domain.UserSession{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	passwordHash := s.dummyHash
+	if user.PasswordHash != nil {
+		passwordHash = []byte(*user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(password)); err != nil || user.PasswordHash == nil {
+		return domain.UserSession{}, domain.ErrInvalidCredentials
+	}
+
+	return s.createSession(ctx, user, s.config.SessionTTL)
+}
+
+// LoginExternal provisions a user on its first sign-on and keeps its email and
+// the workspace roles given by its groups in sync with the identity provider
+// on the following ones. An existing password account with the same email is
+// only taken over when the provider has verified the email.
+func (s *Service) LoginExternal(ctx context.Context, identity domain.ExternalIdentity) (domain.UserSession, error) {
+	email, err := normalizeEmail(identity.Email)
+	if err != nil {
+		return domain.UserSession{}, err
+	}
+	identity.Email = email
+
+	user, err := s.repository.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if errors.Is(err, domain.ErrNotFound) && identity.EmailVerified {
+		user, err = s.repository.GetUserByEmail(ctx, identity.Email)
+		if err == nil && user.OIDCSubject != nil {
+			return domain.UserSession{}, domain.ErrEmailTaken
+		}
+	}
+
+	switch {
+	case errors.Is(err, domain.ErrNotFound):
+		user, err = s.repository.CreateExternalUser(ctx, identity)
+	case err == nil:
+		user, err = s.repository.UpdateExternalUser(ctx, user.ID, identity)
+	}
+	if err != nil {
+		return domain.UserSession{}, fmt.Errorf("failed to provision user: %w", err)
+	}
+
+	if err := s.repository.SyncWorkspaceRoles(ctx, user.ID, identity.WorkspaceRoles); err != nil {
+		return domain.UserSession{}, fmt.Errorf("failed to sync workspace roles: %w", err)
+	}
+
+	return s.createSession(ctx, user, s.config.ExternalSessionTTL)
+}
+
+func (s *Service) Logout(ctx context.Context, token string) error {
+	return s.repository.DeleteSession(ctx, hashToken(token))
+}
+
+func (s *Service) Authenticate(ctx context.Context, token string) (domain.User, error) {
+	if token == "" {
+		return domain.User{}, domain.ErrInvalidCredentials
+	}
+
+	user, err := s.repository.GetSessionUser(ctx, hashToken(token))
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.User{}, domain.ErrInvalidCredentials
+	}
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	return user, nil
+}
+
+// createSession stores a new session for the user. Only a hash of the token
+// is stored, so a leaked table can't be used to sign in.
+func (s *Service) createSession(ctx context.Context, user domain.User, ttl time.Duration) (domain.UserSession, error) {
+	session := domain.UserSession{
+		User:      user,
+		Token:     rand.Text(),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.repository.CreateSession(ctx, hashToken(session.Token), user.ID, ttl); err != nil {
+		return domain.UserSession{}, err
+	}
+	return session, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", fmt.Errorf("invalid email: %s", email)
+	}
+	return email, nil
+}
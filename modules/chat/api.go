@@ -0,0 +1,363 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+// APIHandler exposes the chat service as a JSON API under /api/v1.
+type APIHandler struct {
+	service domain.ChatService
+}
+
+func NewAPIHandler(service domain.ChatService) *APIHandler {
+	return &APIHandler{
+		service: service,
+	}
+}
+
+func (h *APIHandler) Register(e *echo.Echo, middleware ...echo.MiddlewareFunc) {
+	read := httpx.RequireScope(domain.ScopeRead)
+	send := httpx.RequireScope(domain.ScopeSend)
+	manage := httpx.RequireScope(domain.ScopeManage)
+
+	viewer := requireChatAccess(h.service, domain.WorkspaceViewer)
+	editor := requireChatAccess(h.service, domain.WorkspaceEditor)
+	owner := requireChatAccess(h.service, domain.WorkspaceOwner)
+
+	g := e.Group("/api/v1/chats", middleware...)
+	g.GET("", h.listChats, read)
+	g.POST("", h.createChat, manage, httpx.RequireWorkspaceRole(domain.WorkspaceEditor))
+
+	cg := g.Group("/:chat-id")
+	cg.GET("", h.getChat, read, viewer)
+	cg.DELETE("", h.deleteChat, manage, owner)
+	cg.GET("/messages", h.listMessages, read, viewer)
+	cg.POST("/messages", h.sendMessage, send, editor)
+	cg.POST("/cancel", h.cancelGeneration, send, editor)
+	cg.PUT("/settings", h.updateSettings, manage, editor)
+	cg.PUT("/system-prompt", h.updateSystemPrompt, manage, editor)
+	cg.GET("/events", h.streamEvents, read, viewer)
+
+	mg := cg.Group("/messages/:message-id")
+	mg.POST("/edit", h.editMessage, send, editor)
+	mg.POST("/regenerate", h.regenerateMessage, send, editor)
+	mg.POST("/select", h.selectBranch, send, editor)
+}
+
+type createChatRequest struct {
+	Name         string `json:"name"`
+	SystemPrompt string `json:"system_prompt"`
+}
+
+type messageRequest struct {
+	Content string `json:"content"`
+}
+
+type systemPromptRequest struct {
+	SystemPrompt string `json:"system_prompt"`
+}
+
+type chatResponse struct {
+	ID string `json:"id"`
+	domain.ChatPageData
+	NextBefore *string `json:"next_before"`
+}
+
+type messagesResponse struct {
+	Messages   []domain.ChatMessage `json:"messages"`
+	NextBefore *string              `json:"next_before"`
+}
+
+// nextBefore returns the cursor for the page preceding the messages, or nil
+// when they start at the root of the chat.
+func nextBefore(messages []domain.ChatMessage) *string {
+	if len(messages) == 0 || messages[0].ParentID == nil {
+		return nil
+	}
+	return &messages[0].ID
+}
+
+// apiError maps domain errors to HTTP errors, anything else is left to the
+// default error handler.
+func apiError(err error, message string) error {
+	if errors.Is(err, domain.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if errors.Is(err, domain.ErrChatBusy) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return fmt.Errorf("%s: %w", message, err)
+}
+
+func bindJSON(c echo.Context, target any) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(target); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+	}
+	return nil
+}
+
+func (h *APIHandler) listChats(c echo.Context) error {
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+
+	chatSessions, err := h.service.ListSessions(c.Request().Context(), workspace.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list chat sessions: %w", err)
+	}
+	return c.JSON(http.StatusOK, chatSessions)
+}
+
+func (h *APIHandler) createChat(c echo.Context) error {
+	var request createChatRequest
+	if err := bindJSON(c, &request); err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+
+	user, _ := domain.UserFromContext(c.Request().Context())
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+
+	session, err := h.service.CreateChat(
+		c.Request().Context(),
+		workspace.ID,
+		user.ID,
+		name,
+		strings.TrimSpace(request.SystemPrompt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create chat: %w", err)
+	}
+
+	return c.JSON(http.StatusCreated, session)
+}
+
+func (h *APIHandler) getChat(c echo.Context) error {
+	chatId := c.Param("chat-id")
+
+	chatPageData, err := h.service.GetChatPageData(c.Request().Context(), chatId, "")
+	if err != nil {
+		return apiError(err, "failed to get chat")
+	}
+
+	return c.JSON(http.StatusOK, chatResponse{
+		ID:           chatId,
+		ChatPageData: chatPageData,
+		NextBefore:   nextBefore(chatPageData.Messages),
+	})
+}
+
+func (h *APIHandler) listMessages(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	before := c.QueryParam("before")
+
+	var (
+		messages []domain.ChatMessage
+		err      error
+	)
+	if before == "" {
+		var chatPageData domain.ChatPageData
+		chatPageData, err = h.service.GetChatPageData(c.Request().Context(), chatId, "")
+		messages = chatPageData.Messages
+	} else {
+		messages, err = h.service.GetOlderMessages(c.Request().Context(), chatId, before)
+	}
+	if err != nil {
+		return apiError(err, "failed to get messages")
+	}
+
+	return c.JSON(http.StatusOK, messagesResponse{
+		Messages:   messages,
+		NextBefore: nextBefore(messages),
+	})
+}
+
+func (h *APIHandler) sendMessage(c echo.Context) error {
+	chatId := c.Param("chat-id")
+
+	var request messageRequest
+	if err := bindJSON(c, &request); err != nil {
+		return err
+	}
+	if request.Content == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "content is required")
+	}
+
+	if err := h.service.SendMessage(c.Request().Context(), chatId, request.Content); err != nil {
+		return apiError(err, "failed to send message")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *APIHandler) editMessage(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	var request messageRequest
+	if err := bindJSON(c, &request); err != nil {
+		return err
+	}
+	if request.Content == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "content is required")
+	}
+
+	if err := h.service.EditMessage(c.Request().Context(), chatId, messageId, request.Content); err != nil {
+		return apiError(err, "failed to edit message")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *APIHandler) regenerateMessage(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	if err := h.service.RegenerateMessage(c.Request().Context(), chatId, messageId); err != nil {
+		return apiError(err, "failed to regenerate message")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *APIHandler) selectBranch(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	if err := h.service.SelectBranch(c.Request().Context(), chatId, messageId); err != nil {
+		return apiError(err, "failed to select branch")
+	}
+
+	return h.getChat(c)
+}
+
+func (h *APIHandler) cancelGeneration(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	if err := h.service.CancelGeneration(c.Request().Context(), chatId); err != nil {
+		return apiError(err, "failed to cancel generation")
+	}
+	return httpx.NoContent(c)
+}
+
+func (h *APIHandler) deleteChat(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	if err := h.service.DeleteChat(c.Request().Context(), chatId); err != nil {
+		return apiError(err, "failed to delete chat session")
+	}
+	return httpx.NoContent(c)
+}
+
+func (h *APIHandler) updateSettings(c echo.Context) error {
+	chatId := c.Param("chat-id")
+
+	var settings domain.GenerationSettings
+	if err := bindJSON(c, &settings); err != nil {
+		return err
+	}
+	if err := h.service.ValidateSettings(settings); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	session, err := h.service.UpdateChatSettings(c.Request().Context(), chatId, settings)
+	if err != nil {
+		return apiError(err, "failed to update settings")
+	}
+
+	return c.JSON(http.StatusOK, session)
+}
+
+func (h *APIHandler) updateSystemPrompt(c echo.Context) error {
+	chatId := c.Param("chat-id")
+
+	var request systemPromptRequest
+	if err := bindJSON(c, &request); err != nil {
+		return err
+	}
+
+	session, err := h.service.UpdateSystemPrompt(
+		c.Request().Context(),
+		chatId,
+		strings.TrimSpace(request.SystemPrompt),
+	)
+	if err != nil {
+		return apiError(err, "failed to update system prompt")
+	}
+
+	return c.JSON(http.StatusOK, session)
+}
+
+// streamEvents streams the chat events as JSON. Each event is named after
+// its type, apart from "snapshot", sent first with the response in flight
+// when the stream isn't resumed, and "missed", sent when events were dropped
+// and the client should fetch the chat again.
+func (h *APIHandler) streamEvents(c echo.Context) error {
+	httpx.SetupSSE(c)
+	ctx := c.Request().Context()
+	chatId := c.Param("chat-id")
+
+	lastEventId, _ := strconv.ParseInt(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+
+	subscription, err := h.service.SubscribeToMessages(chatId, lastEventId)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to chat: %w", err)
+	}
+	defer subscription.Unsubscribe()
+
+	if snapshot, ok := h.service.GetInFlightResponse(chatId); ok && lastEventId == 0 {
+		if err := writeJSONEvent(c, "", "snapshot", snapshot); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-subscription.Missed:
+			if err := writeJSONEvent(c, "", "missed", struct{}{}); err != nil {
+				return err
+			}
+
+		case message, ok := <-subscription.Messages:
+			if !ok {
+				return nil
+			}
+
+			if err := writeJSONEvent(
+				c,
+				strconv.FormatInt(message.ID, 10),
+				message.Message.Type,
+				message.Message,
+			); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeJSONEvent(c echo.Context, id, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if err := httpx.WriteEventStream(c.Response(), id, event, string(encoded)); err != nil {
+		return err
+	}
+
+	c.Response().Flush()
+	return nil
+}
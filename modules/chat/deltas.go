@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// deltaCoalescer batches streamed text so that flush is called at most once
+// per interval. Text added while a flush is pending is sent along with it.
+type deltaCoalescer struct {
+	interval  time.Duration
+	flush     func(text string)
+	pending   strings.Builder
+	lastFlush time.Time
+	timer     *time.Timer
+	mu        sync.Mutex
+}
+
+func newDeltaCoalescer(interval time.Duration, flush func(text string)) *deltaCoalescer {
+	return &deltaCoalescer{
+		interval: interval,
+		flush:    flush,
+	}
+}
+
+func (c *deltaCoalescer) Add(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending.WriteString(text)
+	if c.timer != nil {
+		return
+	}
+
+	wait := c.interval - time.Since(c.lastFlush)
+	if wait <= 0 {
+		c.flushPending()
+		return
+	}
+
+	c.timer = time.AfterFunc(wait, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.timer = nil
+		c.flushPending()
+	})
+}
+
+// Close flushes the pending text right away. It's safe to call more than once.
+func (c *deltaCoalescer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.flushPending()
+}
+
+// flushPending must be called with the lock held.
+func (c *deltaCoalescer) flushPending() {
+	if c.pending.Len() == 0 {
+		return
+	}
+
+	text := c.pending.String()
+	c.pending.Reset()
+	c.lastFlush = time.Now()
+	c.flush(text)
+}
@@ -1,8 +1,11 @@
 package chat
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/raphael-foliveira/htmbot/domain"
@@ -20,20 +23,39 @@ func NewHandler(service domain.ChatService) *Handler {
 	}
 }
 
-func (h *Handler) Register(e *echo.Echo) {
-	g := e.Group("/chat")
-	g.GET("", h.index)
-	g.POST("", h.create)
+func (h *Handler) Register(e *echo.Echo, middleware ...echo.MiddlewareFunc) {
+	read := httpx.RequireScope(domain.ScopeRead)
+	send := httpx.RequireScope(domain.ScopeSend)
+	manage := httpx.RequireScope(domain.ScopeManage)
+
+	viewer := requireChatAccess(h.service, domain.WorkspaceViewer)
+	editor := requireChatAccess(h.service, domain.WorkspaceEditor)
+	owner := requireChatAccess(h.service, domain.WorkspaceOwner)
+
+	g := e.Group("/chat", middleware...)
+	g.GET("", h.index, read)
+	g.POST("", h.create, manage, httpx.RequireWorkspaceRole(domain.WorkspaceEditor))
 
 	cg := g.Group("/:chat-id")
-	cg.GET("", h.chatPage)
-	cg.POST("/send-message", h.sendMessage)
-	cg.GET("/sse", h.listenForMessages)
-	cg.DELETE("", h.deleteChat)
+	cg.GET("", h.chatPage, read, viewer)
+	cg.GET("/messages", h.olderMessages, read, viewer)
+	cg.POST("/send-message", h.sendMessage, send, editor)
+	cg.POST("/cancel", h.cancelGeneration, send, editor)
+	cg.GET("/sse", h.listenForMessages, read, viewer)
+	cg.DELETE("", h.deleteChat, manage, owner)
+	cg.PUT("/settings", h.updateSettings, manage, editor)
+	cg.PUT("/system-prompt", h.updateSystemPrompt, manage, editor)
+
+	mg := cg.Group("/messages/:message-id")
+	mg.POST("/edit", h.editMessage, send, editor)
+	mg.POST("/regenerate", h.regenerateMessage, send, editor)
+	mg.POST("/select", h.selectBranch, send, editor)
 }
 
 func (h *Handler) index(c echo.Context) error {
-	chatSessions, err := h.service.ListSessions(c.Request().Context())
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+
+	chatSessions, err := h.service.ListSessions(c.Request().Context(), workspace.ID)
 	if err != nil {
 		return fmt.Errorf("failed to list chat sessions: %w", err)
 	}
@@ -46,7 +68,17 @@ func (h *Handler) create(c echo.Context) error {
 		return httpx.NoContent(c)
 	}
 
-	newSession, err := h.service.CreateChat(c.Request().Context(), name)
+	systemPrompt := strings.TrimSpace(c.FormValue("system-prompt"))
+	user, _ := domain.UserFromContext(c.Request().Context())
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+
+	newSession, err := h.service.CreateChat(
+		c.Request().Context(),
+		workspace.ID,
+		user.ID,
+		name,
+		systemPrompt,
+	)
 	if err != nil {
 		return httpx.HxRedirect(c, "/chat")
 	}
@@ -56,12 +88,30 @@ func (h *Handler) create(c echo.Context) error {
 
 func (h *Handler) chatPage(c echo.Context) error {
 	chatId := c.Param("chat-id")
-	chatPageData, err := h.service.GetChatPageData(c.Request().Context(), chatId)
+
+	// Linking to a message shows the path that leads to it without switching
+	// the chat's branch for everyone, which is left to selectBranch.
+	chatPageData, err := h.service.GetChatPageData(c.Request().Context(), chatId, c.QueryParam("message"))
 	if err != nil {
 		return c.Redirect(http.StatusFound, "/chat")
 	}
 
-	return httpx.Render(c, chatviews.ChatPage(chatId, chatPageData.Messages))
+	return httpx.Render(c, chatviews.ChatPage(chatId, chatPageData))
+}
+
+func (h *Handler) olderMessages(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	before := c.QueryParam("before")
+	if before == "" {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	messages, err := h.service.GetOlderMessages(c.Request().Context(), chatId, before)
+	if err != nil {
+		return fmt.Errorf("failed to get older messages: %w", err)
+	}
+
+	return httpx.Render(c, chatviews.OlderMessages(chatId, messages))
 }
 
 func (h *Handler) sendMessage(c echo.Context) error {
@@ -72,13 +122,100 @@ func (h *Handler) sendMessage(c echo.Context) error {
 		return c.NoContent(http.StatusNoContent)
 	}
 
-	if err := h.service.SendMessage(c.Request().Context(), chatName, text); err != nil {
+	err := h.service.SendMessage(c.Request().Context(), chatName, text)
+	if errors.Is(err, domain.ErrChatBusy) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
 
 	return httpx.Render(c, chatviews.ChatForm(chatName))
 }
 
+func (h *Handler) editMessage(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	text := c.FormValue("content")
+	if text == "" {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	err := h.service.EditMessage(c.Request().Context(), chatId, messageId, text)
+	if errors.Is(err, domain.ErrChatBusy) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to edit message: %w", err)
+	}
+
+	return h.renderMessageList(c, chatId)
+}
+
+func (h *Handler) regenerateMessage(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	err := h.service.RegenerateMessage(c.Request().Context(), chatId, messageId)
+	if errors.Is(err, domain.ErrChatBusy) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to regenerate message: %w", err)
+	}
+
+	return h.renderMessageList(c, chatId)
+}
+
+func (h *Handler) selectBranch(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	messageId := c.Param("message-id")
+
+	if err := h.service.SelectBranch(c.Request().Context(), chatId, messageId); err != nil {
+		return fmt.Errorf("failed to select branch: %w", err)
+	}
+
+	return h.renderMessageList(c, chatId)
+}
+
+func (h *Handler) renderMessageList(c echo.Context, chatId string) error {
+	chatPageData, err := h.service.GetChatPageData(c.Request().Context(), chatId, "")
+	if err != nil {
+		return fmt.Errorf("failed to get chat page data: %w", err)
+	}
+
+	return httpx.Render(c, chatviews.ChatMessages(chatId, chatPageData.Messages))
+}
+
+// resyncMessages re-renders the whole message list for a subscriber that
+// missed events or whose path changed.
+func (h *Handler) resyncMessages(c echo.Context, chatId string) error {
+	chatPageData, err := h.service.GetChatPageData(c.Request().Context(), chatId, "")
+	if err != nil {
+		return fmt.Errorf("failed to get chat page data: %w", err)
+	}
+
+	return httpx.WriteEventStreamTemplate(
+		c,
+		"",
+		"chat-messages",
+		chatviews.ResyncMessages(chatId, chatPageData),
+	)
+}
+
+func (h *Handler) cancelGeneration(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	err := h.service.CancelGeneration(c.Request().Context(), chatId)
+	if errors.Is(err, domain.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "no response is being generated")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cancel generation: %w", err)
+	}
+	return httpx.NoContent(c)
+}
+
 func (h *Handler) deleteChat(c echo.Context) error {
 	chatId := c.Param("chat-id")
 	if err := h.service.DeleteChat(c.Request().Context(), chatId); err != nil {
@@ -87,15 +224,95 @@ func (h *Handler) deleteChat(c echo.Context) error {
 	return httpx.HxRedirect(c, "/chat")
 }
 
+func (h *Handler) updateSettings(c echo.Context) error {
+	chatId := c.Param("chat-id")
+
+	settings, err := parseGenerationSettings(c)
+	if err != nil {
+		return httpx.Render(c, chatviews.ChatSettingsForm(chatId, settings, err))
+	}
+
+	session, err := h.service.UpdateChatSettings(c.Request().Context(), chatId, settings)
+	if err != nil {
+		return httpx.Render(c, chatviews.ChatSettingsForm(chatId, settings, err))
+	}
+
+	return httpx.Render(c, chatviews.ChatSettingsForm(chatId, session.GenerationSettings, nil))
+}
+
+func (h *Handler) updateSystemPrompt(c echo.Context) error {
+	chatId := c.Param("chat-id")
+	systemPrompt := strings.TrimSpace(c.FormValue("system-prompt"))
+
+	session, err := h.service.UpdateSystemPrompt(c.Request().Context(), chatId, systemPrompt)
+	if err != nil {
+		return fmt.Errorf("failed to update system prompt: %w", err)
+	}
+
+	return httpx.Render(c, chatviews.SystemPrompt(chatId, session.SystemPrompt))
+}
+
+func parseGenerationSettings(c echo.Context) (domain.GenerationSettings, error) {
+	settings := domain.GenerationSettings{
+		Model:           strings.TrimSpace(c.FormValue("model")),
+		ReasoningEffort: c.FormValue("reasoning-effort"),
+	}
+
+	if value := c.FormValue("temperature"); value != "" {
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return settings, fmt.Errorf("invalid temperature: %s", value)
+		}
+		settings.Temperature = &temperature
+	}
+
+	if value := c.FormValue("top-p"); value != "" {
+		topP, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return settings, fmt.Errorf("invalid top_p: %s", value)
+		}
+		settings.TopP = &topP
+	}
+
+	if value := c.FormValue("max-output-tokens"); value != "" {
+		maxOutputTokens, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return settings, fmt.Errorf("invalid max output tokens: %s", value)
+		}
+		settings.MaxOutputTokens = &maxOutputTokens
+	}
+
+	return settings, nil
+}
+
 func (h *Handler) listenForMessages(c echo.Context) error {
 	httpx.SetupSSE(c)
 	ctx := c.Request().Context()
 	chatName := c.Param("chat-id")
-	messagesChannel, unsub, err := h.service.SubscribeToMessages(chatName)
+
+	// Browsers send the ID of the last event they got when they reconnect.
+	// An ID that can't be parsed is treated as a fresh connection.
+	lastEventId, _ := strconv.ParseInt(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+
+	subscription, err := h.service.SubscribeToMessages(chatName, lastEventId)
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to chat: %w", err)
 	}
-	defer unsub()
+	defer subscription.Unsubscribe()
+
+	// A resumed stream gets the response from the replayed events instead.
+	if snapshot, ok := h.service.GetInFlightResponse(chatName); ok && lastEventId == 0 {
+		if err := httpx.WriteEventStreamTemplate(
+			c,
+			"",
+			"chat-messages",
+			chatviews.MessageSnapshot(snapshot),
+		); err != nil {
+			return err
+		}
+
+		c.Response().Flush()
+	}
 
 	for {
 		select {
@@ -103,11 +320,34 @@ func (h *Handler) listenForMessages(c echo.Context) error {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case message := <-messagesChannel:
+		case <-subscription.Missed:
+			if err := h.resyncMessages(c, chatName); err != nil {
+				return err
+			}
+
+			c.Response().Flush()
+
+		case message, ok := <-subscription.Messages:
+			if !ok {
+				return nil
+			}
+
+			// A message that starts a new branch replaces the rest of the
+			// path, so the list is rendered again instead of appended to.
+			if message.Message.Type == "message" && len(message.Message.OfMessage.SiblingIDs) > 1 {
+				if err := h.resyncMessages(c, chatName); err != nil {
+					return err
+				}
+
+				c.Response().Flush()
+				continue
+			}
+
 			if err := httpx.WriteEventStreamTemplate(
 				c,
+				strconv.FormatInt(message.ID, 10),
 				"chat-messages",
-				chatviews.GetMessageTemplate(message),
+				chatviews.GetMessageTemplate(message.Message),
 			); err != nil {
 				return err
 			}
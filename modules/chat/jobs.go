@@ -2,29 +2,305 @@ package chat
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/raphael-foliveira/htmbot/domain"
 )
 
-type MessageEnqueuer struct {
-	ch chan domain.ChatEvent
+var (
+	_ domain.MessageEnqueuer = &InMemoryQueue{}
+	_ domain.MessageConsumer = &InMemoryQueue{}
+	_ domain.MessageEnqueuer = &PGXQueue{}
+	_ domain.MessageConsumer = &PGXQueue{}
+)
+
+// InMemoryQueue keeps jobs in a channel. Jobs are lost when the process exits
+// and failed jobs are not retried.
+type InMemoryQueue struct {
+	ch chan domain.MessageJob
+	// pending maps the jobs that haven't been completed or failed to their
+	// chat.
+	pending map[string]string
+	mu      sync.Mutex
 }
 
-func NewMessageEnqueuer(ch chan domain.ChatEvent) *MessageEnqueuer {
-	return &MessageEnqueuer{
-		ch: ch,
+func NewInMemoryQueue(size int) *InMemoryQueue {
+	return &InMemoryQueue{
+		ch:      make(chan domain.MessageJob, size),
+		pending: map[string]string{},
 	}
 }
 
-func (e *MessageEnqueuer) EnqueueUserMessage(ctx context.Context, chatName, message string) error {
+func (q *InMemoryQueue) EnqueueUserMessage(ctx context.Context, chatId string, message domain.ChatMessage) error {
+	job := domain.MessageJob{
+		ID:            uuid.New().String(),
+		ChatSessionID: chatId,
+		MessageID:     message.ID,
+	}
+
+	q.mu.Lock()
+	q.pending[job.ID] = chatId
+	q.mu.Unlock()
+
 	select {
 	case <-ctx.Done():
+		q.finish(job.ID)
 		return ctx.Err()
-	case e.ch <- domain.ChatEvent{
-		ChatSessionID: chatName,
-		Type:          "message",
-		OfMessage:     domain.ChatMessage{Role: "user", Content: message},
-	}:
+	case q.ch <- job:
 		return nil
 	}
 }
+
+func (q *InMemoryQueue) HasPendingJob(ctx context.Context, chatId string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, pendingChatId := range q.pending {
+		if pendingChatId == chatId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *InMemoryQueue) finish(jobId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, jobId)
+}
+
+func (q *InMemoryQueue) DequeueUserMessage(ctx context.Context) (domain.MessageJob, error) {
+	select {
+	case <-ctx.Done():
+		return domain.MessageJob{}, ctx.Err()
+	case job := <-q.ch:
+		job.Attempts++
+		return job, nil
+	}
+}
+
+// ExtendJob does nothing, the queue never hands a job out again.
+func (q *InMemoryQueue) ExtendJob(ctx context.Context, jobId string) error {
+	return nil
+}
+
+func (q *InMemoryQueue) CompleteJob(ctx context.Context, jobId string) error {
+	q.finish(jobId)
+	return nil
+}
+
+func (q *InMemoryQueue) FailJob(ctx context.Context, jobId string, cause error) (bool, error) {
+	q.finish(jobId)
+	return false, nil
+}
+
+func (q *InMemoryQueue) PendingJobs(ctx context.Context) (int, error) {
+	return len(q.ch), nil
+}
+
+type PGXQueueConfig struct {
+	// VisibilityTimeout is how long a dequeued or extended job stays hidden
+	// from other consumers. A job that is still unfinished after that is
+	// handed out again.
+	VisibilityTimeout time.Duration
+	// MaxAttempts is how many times a job is handed out before it's given up.
+	MaxAttempts int
+	// PollInterval is how long DequeueUserMessage waits between polls while
+	// the queue is empty.
+	PollInterval time.Duration
+}
+
+func (c *PGXQueueConfig) ApplyDefaults() {
+	if c.VisibilityTimeout == 0 {
+		c.VisibilityTimeout = 10 * time.Minute
+	}
+
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 3
+	}
+
+	if c.PollInterval == 0 {
+		c.PollInterval = time.Second
+	}
+}
+
+// PGXQueue stores jobs in the message_jobs table, so they survive restarts and
+// can be consumed by several instances at once.
+type PGXQueue struct {
+	pool   *pgxpool.Pool
+	config PGXQueueConfig
+}
+
+func NewPGXQueue(pool *pgxpool.Pool, config PGXQueueConfig) *PGXQueue {
+	config.ApplyDefaults()
+	return &PGXQueue{
+		pool:   pool,
+		config: config,
+	}
+}
+
+const enqueueJobQuery = `
+INSERT INTO message_jobs (chat_session_id, message_id) VALUES ($1, $2);
+`
+
+func (q *PGXQueue) EnqueueUserMessage(ctx context.Context, chatId string, message domain.ChatMessage) error {
+	if _, err := q.pool.Exec(ctx, enqueueJobQuery, chatId, message.ID); err != nil {
+		return fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return nil
+}
+
+const hasPendingJobQuery = `
+SELECT EXISTS (
+	SELECT 1 FROM message_jobs WHERE chat_session_id = $1 AND failed_at IS NULL
+);
+`
+
+func (q *PGXQueue) HasPendingJob(ctx context.Context, chatId string) (bool, error) {
+	var pending bool
+	if err := q.pool.QueryRow(ctx, hasPendingJobQuery, chatId).Scan(&pending); err != nil {
+		return false, fmt.Errorf("failed to check pending jobs: %w", err)
+	}
+	return pending, nil
+}
+
+// dequeueJobQuery claims the oldest visible job and hides it for the
+// visibility timeout. SKIP LOCKED lets concurrent consumers claim different
+// jobs instead of waiting on each other. A job is only claimed once every older
+// job of its chat has finished, so a chat's messages are answered in order even
+// across instances. A job that is visible again after its last attempt was
+// abandoned without being failed, e.g. because the process was killed, is
+// failed as it's claimed so it doesn't hold up its chat.
+const dequeueJobQuery = `
+WITH next_job AS (
+	SELECT j.id
+	FROM message_jobs j
+	WHERE j.failed_at IS NULL
+		AND j.visible_at <= NOW()
+		AND NOT EXISTS (
+			SELECT 1
+			FROM message_jobs o
+			WHERE o.chat_session_id = j.chat_session_id
+				AND o.failed_at IS NULL
+				AND (o.created_at, o.id) < (j.created_at, j.id)
+		)
+	ORDER BY j.created_at
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+UPDATE message_jobs j
+SET attempts = LEAST(j.attempts + 1, $2),
+	visible_at = NOW() + make_interval(secs => $1),
+	failed_at = CASE WHEN j.attempts >= $2 THEN NOW() END,
+	last_error = CASE WHEN j.attempts >= $2 THEN 'abandoned on its last attempt' ELSE j.last_error END
+FROM next_job
+WHERE j.id = next_job.id
+RETURNING j.id, j.chat_session_id, j.message_id, j.attempts, j.failed_at IS NOT NULL AS abandoned;
+`
+
+func (q *PGXQueue) DequeueUserMessage(ctx context.Context) (domain.MessageJob, error) {
+	for {
+		job, err := q.claimJob(ctx)
+		if err == nil {
+			return job, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return domain.MessageJob{}, fmt.Errorf("failed to dequeue job: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return domain.MessageJob{}, ctx.Err()
+		case <-time.After(q.config.PollInterval):
+		}
+	}
+}
+
+func (q *PGXQueue) claimJob(ctx context.Context) (domain.MessageJob, error) {
+	rows, err := q.pool.Query(
+		ctx,
+		dequeueJobQuery,
+		q.config.VisibilityTimeout.Seconds(),
+		q.config.MaxAttempts,
+	)
+	if err != nil {
+		return domain.MessageJob{}, err
+	}
+
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.MessageJob])
+}
+
+// extendJobQuery leaves failed jobs alone, a job failed as abandoned isn't
+// brought back by a late heartbeat.
+const extendJobQuery = `
+UPDATE message_jobs
+SET visible_at = NOW() + make_interval(secs => $2)
+WHERE id = $1 AND failed_at IS NULL;
+`
+
+func (q *PGXQueue) ExtendJob(ctx context.Context, jobId string) error {
+	if _, err := q.pool.Exec(ctx, extendJobQuery, jobId, q.config.VisibilityTimeout.Seconds()); err != nil {
+		return fmt.Errorf("failed to extend job: %w", err)
+	}
+	return nil
+}
+
+const completeJobQuery = `
+DELETE FROM message_jobs WHERE id = $1;
+`
+
+func (q *PGXQueue) CompleteJob(ctx context.Context, jobId string) error {
+	if _, err := q.pool.Exec(ctx, completeJobQuery, jobId); err != nil {
+		return fmt.Errorf("failed to complete job: %w", err)
+	}
+	return nil
+}
+
+// failJobQuery makes the job visible again after a backoff that grows with
+// each attempt, or marks it as failed once it has run out of attempts.
+const failJobQuery = `
+UPDATE message_jobs
+SET last_error = $2,
+	visible_at = NOW() + make_interval(secs => attempts * $3::float8),
+	failed_at = CASE WHEN attempts >= $4 THEN NOW() END
+WHERE id = $1
+RETURNING failed_at IS NULL;
+`
+
+const failJobBackoff = 10 * time.Second
+
+func (q *PGXQueue) FailJob(ctx context.Context, jobId string, cause error) (bool, error) {
+	var retrying bool
+	if err := q.pool.QueryRow(
+		ctx,
+		failJobQuery,
+		jobId,
+		cause.Error(),
+		failJobBackoff.Seconds(),
+		q.config.MaxAttempts,
+	).Scan(&retrying); err != nil {
+		return false, fmt.Errorf("failed to fail job: %w", err)
+	}
+	return retrying, nil
+}
+
+const pendingJobsQuery = `
+SELECT COUNT(*)
+FROM message_jobs
+WHERE failed_at IS NULL
+	AND visible_at <= NOW();
+`
+
+func (q *PGXQueue) PendingJobs(ctx context.Context) (int, error) {
+	var count int
+	if err := q.pool.QueryRow(ctx, pendingJobsQuery).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count pending jobs: %w", err)
+	}
+	return count, nil
+}
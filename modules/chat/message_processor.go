@@ -2,89 +2,393 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/markdown"
+	"github.com/raphael-foliveira/htmbot/platform/slicesx"
 )
 
+type MessageProcessorConfig struct {
+	// Workers is how many messages are processed at the same time. Messages of
+	// the same chat are always processed one at a time, in order.
+	Workers int
+	// DeltasPerSecond caps how many delta events are published per second
+	// for a response. Text streamed in between is batched into one delta.
+	DeltasPerSecond int
+	// HeartbeatInterval is how often a job being processed is extended. It
+	// must be shorter than the visibility timeout of the queue.
+	HeartbeatInterval time.Duration
+	Registerer        prometheus.Registerer
+}
+
+// ApplyDefaults also replaces values below 1, which would leave the processor
+// without workers or make the delta interval negative.
+func (c *MessageProcessorConfig) ApplyDefaults() {
+	if c.Workers < 1 {
+		c.Workers = 4
+	}
+
+	if c.DeltasPerSecond < 1 {
+		c.DeltasPerSecond = 10
+	}
+
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = time.Minute
+	}
+}
+
 type MessageProcessor struct {
-	ch         chan domain.ChatEvent
+	consumer   domain.MessageConsumer
 	publisher  domain.PubSub[domain.ChatEvent]
 	agent      domain.LLMAgent
 	repository domain.ChatRepository
+	runs       domain.RunRegistry
+	snapshots  domain.ResponseSnapshots
+	config     MessageProcessorConfig
+	metrics    *processorMetrics
 }
 
 func NewMessageProcessor(
-	ch chan domain.ChatEvent,
+	consumer domain.MessageConsumer,
 	publisher domain.PubSub[domain.ChatEvent],
 	agent domain.LLMAgent,
 	repository domain.ChatRepository,
+	runs domain.RunRegistry,
+	snapshots domain.ResponseSnapshots,
+	config MessageProcessorConfig,
 ) *MessageProcessor {
+	config.ApplyDefaults()
 	return &MessageProcessor{
-		ch:         ch,
+		consumer:   consumer,
 		publisher:  publisher,
 		agent:      agent,
 		repository: repository,
+		runs:       runs,
+		snapshots:  snapshots,
+		config:     config,
+		metrics:    newProcessorMetrics(config.Registerer, consumer),
 	}
 }
 
+// ProcessUserMessages dequeues jobs and runs them on a pool of workers until ctx
+// is done. A job is only dequeued when a worker is free to take it. A failing
+// job is reported to its chat and doesn't stop the other workers.
 func (p *MessageProcessor) ProcessUserMessages(ctx context.Context) error {
+	slots := make(chan struct{}, p.config.Workers)
+	ready := make(chan domain.MessageJob, p.config.Workers)
+	scheduler := newChatScheduler(ready)
+
+	p.metrics.workers.Set(float64(p.config.Workers))
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for range p.config.Workers {
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-ready:
+					p.runJob(ctx, job)
+					scheduler.done(job)
+					p.metrics.waitingJobs.Set(float64(scheduler.waitingJobs()))
+					<-slots
+				}
+			}
+		})
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case newMessage := <-p.ch:
-			chatMessages, err := p.repository.GetMessages(ctx, domain.GetMessagesParams{
-				ChatSessionId: newMessage.ChatSessionID,
-				Limit:         30,
-			})
-			if err != nil {
-				log.Errorf("failed to get chat messages: %w", err)
-				continue
-			}
-
-			deltaId := uuid.New().String()
+		case slots <- struct{}{}:
+		}
 
-			if err := p.publisher.Publish(newMessage.ChatSessionID, domain.ChatEvent{
-				Type:          "delta_start",
-				ChatSessionID: newMessage.ChatSessionID,
-				OfDelta: domain.ChatDelta{
-					ID: deltaId,
-				},
-			}); err != nil {
-				log.Errorf("failed to publish delta_start event: %w", err)
+		job, err := p.consumer.DequeueUserMessage(ctx)
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			log.Errorf("failed to dequeue user message: %v", err)
 
-			builder := strings.Builder{}
-			response, err := p.agent.StreamResponse(
-				ctx,
-				append(chatMessages, newMessage.OfMessage),
-				[]domain.LLMTool{NewTestTool()},
-				func(delta string) {
-					builder.WriteString(delta)
-					if err := p.publisher.Publish(newMessage.ChatSessionID, domain.ChatEvent{
-						Type:          "delta",
-						ChatSessionID: newMessage.ChatSessionID,
-						OfDelta: domain.ChatDelta{
-							ID:   deltaId,
-							Text: builder.String(),
-						},
-					}); err != nil {
-						log.Errorf("failed to publish delta event: %w", err)
-					}
-				},
-			)
-			if err != nil {
-				return fmt.Errorf("failed to stream response: %w", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
 			}
+			continue
+		}
+
+		if job.Abandoned {
+			<-slots
+			p.snapshots.Finish(job.ChatSessionID)
+			p.publishFailure(job, false)
+			continue
+		}
 
-			if err := p.repository.SaveMessage(ctx, newMessage.ChatSessionID, response...); err != nil {
-				return fmt.Errorf("failed to save assistant message: %w", err)
+		scheduler.schedule(job)
+		p.metrics.waitingJobs.Set(float64(scheduler.waitingJobs()))
+	}
+}
+
+func (p *MessageProcessor) runJob(ctx context.Context, job domain.MessageJob) {
+	p.metrics.busyWorkers.Inc()
+	defer p.metrics.busyWorkers.Dec()
+	defer p.snapshots.Finish(job.ChatSessionID)
+	start := time.Now()
+
+	stopHeartbeat := p.heartbeat(ctx, job)
+	err := p.processJobRecovered(ctx, job)
+	stopHeartbeat()
+
+	if err == nil {
+		p.metrics.jobDuration.WithLabelValues("completed").Observe(time.Since(start).Seconds())
+		if err := p.consumer.CompleteJob(ctx, job.ID); err != nil {
+			log.Errorf("failed to complete job: %v", err)
+		}
+		return
+	}
+
+	p.metrics.jobDuration.WithLabelValues("failed").Observe(time.Since(start).Seconds())
+
+	// The processor is shutting down, the job is handed out again once the
+	// queue considers it abandoned.
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Errorf("failed to process message %s of chat %s: %v", job.MessageID, job.ChatSessionID, err)
+
+	retrying, err := p.consumer.FailJob(ctx, job.ID, err)
+	if err != nil {
+		log.Errorf("failed to record job failure: %v", err)
+	}
+
+	p.publishFailure(job, retrying)
+}
+
+// heartbeat extends the job while it's processed, so a long run isn't handed
+// out to another worker. The returned function stops it and waits for it to
+// return, so the job isn't extended after it's completed or failed.
+func (p *MessageProcessor) heartbeat(ctx context.Context, job domain.MessageJob) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.consumer.ExtendJob(ctx, job.ID); err != nil && ctx.Err() == nil {
+					log.Errorf("failed to extend job %s: %v", job.ID, err)
+				}
 			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
 
+// publishFailure shows the failure of the job in its chat.
+func (p *MessageProcessor) publishFailure(job domain.MessageJob, retrying bool) {
+	if err := p.publisher.Publish(job.ChatSessionID, domain.ChatEvent{
+		Type:          "error",
+		ChatSessionID: job.ChatSessionID,
+		OfFailure: domain.ChatFailure{
+			ID:        job.ID,
+			MessageID: job.MessageID,
+			Retrying:  retrying,
+		},
+	}); err != nil {
+		log.Errorf("failed to publish error event: %v", err)
+	}
+}
+
+func (p *MessageProcessor) processJobRecovered(ctx context.Context, job domain.MessageJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing job: %v", r)
+		}
+	}()
+	return p.processJob(ctx, job)
+}
+
+// processJob streams the response to a delta identified by the job ID, so that
+// a retry of the job keeps streaming to the same bubble. The run is tracked
+// before the snapshot is started, since the snapshot is what tells that there
+// is a run to cancel.
+func (p *MessageProcessor) processJob(ctx context.Context, job domain.MessageJob) error {
+	runCtx, done := p.runs.Track(ctx, job.ChatSessionID)
+	defer done()
+
+	deltaId := job.ID
+	p.startDelta(job, deltaId)
+
+	chatMessages, err := p.repository.GetMessages(ctx, domain.GetMessagesParams{
+		ChatSessionId: job.ChatSessionID,
+		LeafID:        job.MessageID,
+		Limit:         30,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get chat messages: %w", err)
+	}
+
+	session, err := p.repository.GetSession(ctx, job.ChatSessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get chat session: %w", err)
+	}
+
+	// builder holds the text published so far, which is what subscribers
+	// and the snapshot have seen.
+	builder := strings.Builder{}
+	seq, settled := 0, 0
+	deltas := newDeltaCoalescer(time.Second/time.Duration(p.config.DeltasPerSecond), func(text string) {
+		seq++
+		builder.WriteString(text)
+		streamed := builder.String()
+		p.snapshots.Update(job.ChatSessionID, seq, text)
+
+		previouslySettled := settled
+		settled = markdown.SettledLength(streamed)
+		if err := p.publisher.Publish(job.ChatSessionID, domain.ChatEvent{
+			Type:          "delta",
+			ChatSessionID: job.ChatSessionID,
+			OfDelta: domain.ChatDelta{
+				ID:      deltaId,
+				Text:    text,
+				Seq:     seq,
+				Settled: streamed[previouslySettled:settled],
+				Pending: streamed[settled:],
+			},
+		}); err != nil {
+			log.Errorf("failed to publish delta event: %v", err)
+		}
+	})
+	defer deltas.Close()
+
+	response, err := p.agent.StreamResponse(
+		runCtx,
+		p.buildContext(session, chatMessages),
+		p.observeTools(job.ChatSessionID, Tools()),
+		session.GenerationSettings,
+		deltas.Add,
+	)
+	deltas.Close()
+
+	if err != nil && errors.Is(context.Cause(runCtx), domain.ErrRunCancelled) {
+		return p.saveCancelledResponse(ctx, job, deltaId, builder.String())
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to stream response: %w", err)
+	}
+
+	if len(response) > 0 {
+		response[0].ParentID = &job.MessageID
+	}
+
+	if err := p.repository.SaveMessage(ctx, job.ChatSessionID, response...); err != nil {
+		return fmt.Errorf("failed to save assistant message: %w", err)
+	}
+
+	return nil
+}
+
+// startDelta opens the bubble the response is streamed to. A retried job
+// already has one, showing the previous failure, which the new bubble
+// replaces.
+func (p *MessageProcessor) startDelta(job domain.MessageJob, deltaId string) {
+	p.snapshots.Start(job.ChatSessionID, deltaId)
+
+	if err := p.publisher.Publish(job.ChatSessionID, domain.ChatEvent{
+		Type:          "delta_start",
+		ChatSessionID: job.ChatSessionID,
+		OfDelta: domain.ChatDelta{
+			ID: deltaId,
+		},
+	}); err != nil {
+		log.Errorf("failed to publish delta_start event: %v", err)
+	}
+}
+
+func (p *MessageProcessor) saveCancelledResponse(
+	ctx context.Context,
+	job domain.MessageJob,
+	deltaId, text string,
+) error {
+	chatSessionId := job.ChatSessionID
+	message := domain.ChatMessage{
+		ParentID:  &job.MessageID,
+		Role:      "assistant",
+		Content:   text,
+		Cancelled: true,
+	}
+
+	if err := p.repository.SaveMessage(ctx, chatSessionId, message); err != nil {
+		return fmt.Errorf("failed to save cancelled message: %w", err)
+	}
+
+	if err := p.publisher.Publish(chatSessionId, domain.ChatEvent{
+		Type:          "cancelled",
+		ChatSessionID: chatSessionId,
+		OfDelta: domain.ChatDelta{
+			ID:   deltaId,
+			Text: text,
+		},
+	}); err != nil {
+		log.Errorf("failed to publish cancelled event: %v", err)
+	}
+
+	return nil
+}
+
+// buildContext prepends the system prompt to the history, which already ends
+// with the user message being answered.
+func (p *MessageProcessor) buildContext(
+	session domain.ChatSession,
+	history []domain.ChatMessage,
+) []domain.ChatMessage {
+	messages := make([]domain.ChatMessage, 0, len(history)+1)
+	if session.SystemPrompt != "" {
+		messages = append(messages, domain.ChatMessage{
+			Role:    "system",
+			Content: session.SystemPrompt,
+		})
+	}
+	return append(messages, history...)
+}
+
+func (p *MessageProcessor) observeTools(chatSessionId string, tools []domain.LLMTool) []domain.LLMTool {
+	publish := func(eventType string) func(domain.ToolCallEvent) {
+		return func(toolCall domain.ToolCallEvent) {
+			if err := p.publisher.Publish(chatSessionId, domain.ChatEvent{
+				Type:          eventType,
+				ChatSessionID: chatSessionId,
+				OfToolCall:    toolCall,
+			}); err != nil {
+				log.Errorf("failed to publish %s event: %v", eventType, err)
+			}
 		}
 	}
+
+	return slicesx.Map(tools, func(tool domain.LLMTool) domain.LLMTool {
+		return newObservedTool(tool, publish("tool_call_started"), publish("tool_call_finished"))
+	})
 }
@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/pubsub"
+)
+
+// fakeConsumer records what the processor reports about its jobs, in order.
+type fakeConsumer struct {
+	mu       sync.Mutex
+	calls    []string
+	retrying bool
+	failures []error
+}
+
+func (c *fakeConsumer) record(call string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *fakeConsumer) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.calls)
+}
+
+func (c *fakeConsumer) DequeueUserMessage(ctx context.Context) (domain.MessageJob, error) {
+	<-ctx.Done()
+	return domain.MessageJob{}, ctx.Err()
+}
+
+func (c *fakeConsumer) ExtendJob(ctx context.Context, jobId string) error {
+	c.record("extend")
+	return nil
+}
+
+func (c *fakeConsumer) CompleteJob(ctx context.Context, jobId string) error {
+	c.record("complete")
+	return nil
+}
+
+func (c *fakeConsumer) FailJob(ctx context.Context, jobId string, cause error) (bool, error) {
+	c.record("fail")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, cause)
+	return c.retrying, nil
+}
+
+func (c *fakeConsumer) PendingJobs(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// stubAgent answers every message with respond.
+type stubAgent struct {
+	respond func(ctx context.Context) ([]domain.ChatMessage, error)
+}
+
+func (a *stubAgent) GenerateResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) ([]domain.ChatMessage, error) {
+	return a.respond(ctx)
+}
+
+func (a *stubAgent) StreamResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+	callback func(delta string),
+) ([]domain.ChatMessage, error) {
+	return a.respond(ctx)
+}
+
+func (a *stubAgent) ValidateSettings(settings domain.GenerationSettings) error {
+	return nil
+}
+
+type processorTest struct {
+	processor  *MessageProcessor
+	consumer   *fakeConsumer
+	repository *fakeRepository
+	events     domain.Subscription[domain.ChatEvent]
+	job        domain.MessageJob
+}
+
+func newProcessorTest(t *testing.T, agent domain.LLMAgent, config MessageProcessorConfig) *processorTest {
+	userMessage := domain.ChatMessage{ID: "message-1", Role: "user", Content: "Hi"}
+	repository := &fakeRepository{
+		session: domain.ChatSession{ID: "chat-1"},
+		saved:   []domain.ChatMessage{userMessage},
+	}
+	consumer := &fakeConsumer{}
+	publisher := pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+
+	events, err := publisher.Subscribe("chat-1", domain.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	t.Cleanup(events.Unsubscribe)
+
+	return &processorTest{
+		processor: NewMessageProcessor(
+			consumer, publisher, agent, repository, NewRuns(publisher), NewSnapshots(), config,
+		),
+		consumer:   consumer,
+		repository: repository,
+		events:     events,
+		job:        domain.MessageJob{ID: "job-1", ChatSessionID: "chat-1", MessageID: userMessage.ID, Attempts: 1},
+	}
+}
+
+func TestMessageProcessorExtendsJobWhileProcessing(t *testing.T) {
+	test := newProcessorTest(t, &stubAgent{
+		respond: func(ctx context.Context) ([]domain.ChatMessage, error) {
+			time.Sleep(100 * time.Millisecond)
+			return []domain.ChatMessage{{Role: "assistant", Content: "Hello"}}, nil
+		},
+	}, MessageProcessorConfig{HeartbeatInterval: 10 * time.Millisecond})
+
+	test.processor.runJob(context.Background(), test.job)
+	time.Sleep(30 * time.Millisecond)
+
+	calls := test.consumer.recorded()
+	if len(calls) < 3 || calls[len(calls)-1] != "complete" {
+		t.Fatalf("got calls %v, want the job extended while processed and then completed", calls)
+	}
+	for _, call := range calls[:len(calls)-1] {
+		if call != "extend" {
+			t.Errorf("got calls %v, want only extends before the completion", calls)
+			break
+		}
+	}
+}
+
+func TestMessageProcessorReportsFailedJobs(t *testing.T) {
+	cause := errors.New("invalid model")
+	test := newProcessorTest(t, &stubAgent{
+		respond: func(ctx context.Context) ([]domain.ChatMessage, error) {
+			return nil, cause
+		},
+	}, MessageProcessorConfig{})
+	test.consumer.retrying = true
+
+	test.processor.runJob(context.Background(), test.job)
+
+	if calls := test.consumer.recorded(); !slices.Equal(calls, []string{"fail"}) {
+		t.Fatalf("got calls %v, want the job failed", calls)
+	}
+	if len(test.consumer.failures) != 1 || !errors.Is(test.consumer.failures[0], cause) {
+		t.Errorf("got failures %v, want %v", test.consumer.failures, cause)
+	}
+	if len(test.repository.saved) != 1 {
+		t.Errorf("got %d saved messages, want no response saved", len(test.repository.saved))
+	}
+
+	var failure *domain.ChatEvent
+	for failure == nil {
+		select {
+		case event := <-test.events.Messages:
+			if event.Message.Type == "error" {
+				failure = &event.Message
+			}
+		default:
+			t.Fatal("no error event was published")
+		}
+	}
+	want := domain.ChatFailure{ID: test.job.ID, MessageID: test.job.MessageID, Retrying: true}
+	if failure.OfFailure != want {
+		t.Errorf("got failure %+v, want %+v", failure.OfFailure, want)
+	}
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+type processorMetrics struct {
+	workers     prometheus.Gauge
+	busyWorkers prometheus.Gauge
+	waitingJobs prometheus.Gauge
+	jobDuration *prometheus.HistogramVec
+}
+
+// newProcessorMetrics registers the processor metrics with registerer. A nil
+// registerer creates the metrics without exposing them.
+func newProcessorMetrics(registerer prometheus.Registerer, consumer domain.MessageConsumer) *processorMetrics {
+	factory := promauto.With(registerer)
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "htmbot_message_jobs_pending",
+		Help: "Jobs in the queue waiting to be picked up by a worker.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		pending, err := consumer.PendingJobs(ctx)
+		if err != nil {
+			log.Errorf("failed to count pending jobs: %v", err)
+			return 0
+		}
+		return float64(pending)
+	})
+
+	return &processorMetrics{
+		workers: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "htmbot_message_workers",
+			Help: "Workers processing user messages.",
+		}),
+		busyWorkers: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "htmbot_message_workers_busy",
+			Help: "Workers currently processing a user message.",
+		}),
+		waitingJobs: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "htmbot_message_jobs_waiting",
+			Help: "Dequeued jobs waiting for an earlier job of the same chat to finish.",
+		}),
+		jobDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "htmbot_message_job_duration_seconds",
+			Help:    "Time spent processing a user message, by outcome.",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"outcome"}),
+	}
+}
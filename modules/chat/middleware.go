@@ -0,0 +1,37 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// requireChatAccess guards the routes of a single chat, answering 404 when the
+// chat in the path isn't accessible to the authenticated user and 403 when
+// their role in its workspace is less privileged than role. The workspace of
+// the chat replaces the current one in the request context.
+func requireChatAccess(service domain.ChatService, role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			user, _ := domain.UserFromContext(ctx)
+
+			membership, err := service.AuthorizeChat(ctx, user.ID, c.Param("chat-id"), role)
+			if errors.Is(err, domain.ErrNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "chat not found")
+			}
+			if errors.Is(err, domain.ErrAccessDenied) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("requires the %s role", role))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to authorize chat: %w", err)
+			}
+
+			c.SetRequest(c.Request().WithContext(domain.WithWorkspace(ctx, membership)))
+			return next(c)
+		}
+	}
+}
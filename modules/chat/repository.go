@@ -2,9 +2,11 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/raphael-foliveira/htmbot/domain"
@@ -23,11 +25,14 @@ func NewPGXRepository(pool *pgxpool.Pool) *PGXRepository {
 }
 
 const createChatQuery = `
-INSERT INTO chats (name) VALUES ($1) RETURNING *;
+INSERT INTO chats (workspace_id, user_id, name, system_prompt) VALUES ($1, $2, $3, $4) RETURNING *;
 `
 
-func (p *PGXRepository) CreateChat(ctx context.Context, chatName string) (domain.ChatSession, error) {
-	rows, err := p.pool.Query(ctx, createChatQuery, chatName)
+func (p *PGXRepository) CreateChat(
+	ctx context.Context,
+	workspaceId, userId, chatName, systemPrompt string,
+) (domain.ChatSession, error) {
+	rows, err := p.pool.Query(ctx, createChatQuery, workspaceId, userId, chatName, systemPrompt)
 	if err != nil {
 		return domain.ChatSession{}, fmt.Errorf("failed to create chat: %w", err)
 	}
@@ -36,52 +41,159 @@ func (p *PGXRepository) CreateChat(ctx context.Context, chatName string) (domain
 }
 
 const getMessagesQuery = `
-SELECT id, role, content, name, args, call_id, result, chat_session_id, created_at
-FROM chat_messages
-WHERE chat_session_id = $1 AND content <> ''
-AND created_at < $2
-ORDER BY created_at DESC
-LIMIT $3;
+WITH RECURSIVE path AS (
+	SELECT m.*, 0 AS depth
+	FROM chat_messages m
+	WHERE m.chat_session_id = $1
+	AND m.id = COALESCE($2::uuid, (SELECT current_leaf_id FROM chats WHERE id = $1))
+	UNION ALL
+	SELECT m.*, path.depth + 1
+	FROM chat_messages m
+	JOIN path ON m.id = path.parent_id
+)
+SELECT
+	p.id, p.parent_id, p.role, p.content, p.name, p.args, p.call_id, p.result,
+	p.cancelled, p.chat_session_id, p.created_at,
+	ARRAY(
+		SELECT s.id::text
+		FROM chat_messages s
+		WHERE s.chat_session_id = p.chat_session_id
+		AND s.parent_id IS NOT DISTINCT FROM p.parent_id
+		ORDER BY s.seq
+	) AS sibling_ids
+FROM path p
+WHERE p.created_at < $3
+ORDER BY p.depth ASC
+LIMIT $4;
 `
 
 func (p *PGXRepository) GetMessages(ctx context.Context, params domain.GetMessagesParams) ([]domain.ChatMessage, error) {
 	params.ApplyDefaults()
+
+	var leafId *string
+	if params.LeafID != "" {
+		leafId = &params.LeafID
+	}
+
 	rows, err := p.pool.Query(
 		ctx,
 		getMessagesQuery,
 		params.ChatSessionId,
+		leafId,
 		params.Before,
 		params.Limit,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query chat messages: %w", err)
 	}
+	defer rows.Close()
 
 	messages := []domain.ChatMessage{}
 
 	for rows.Next() {
-		var message domain.ChatMessage
-		if err := rows.Scan(
-			&message.ID,
-			&message.Role,
-			&message.Content,
-			&message.Name,
-			&message.Args,
-			&message.CallID,
-			&message.Result,
-			&message.ChatSessionID,
-			&message.CreatedAt,
-		); err != nil {
-			return nil, fmt.Errorf("failed to scan chat message: %w", err)
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
 		}
 		messages = append(messages, message)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat messages: %w", err)
+	}
 
 	slices.Reverse(messages)
 
 	return messages, nil
 }
 
+const getMessageQuery = `
+SELECT
+	m.id, m.parent_id, m.role, m.content, m.name, m.args, m.call_id, m.result,
+	m.cancelled, m.chat_session_id, m.created_at,
+	ARRAY(
+		SELECT s.id::text
+		FROM chat_messages s
+		WHERE s.chat_session_id = m.chat_session_id
+		AND s.parent_id IS NOT DISTINCT FROM m.parent_id
+		ORDER BY s.seq
+	) AS sibling_ids
+FROM chat_messages m
+WHERE m.chat_session_id = $1 AND m.id = $2;
+`
+
+func (p *PGXRepository) GetMessage(ctx context.Context, chatId, messageId string) (domain.ChatMessage, error) {
+	message, err := scanMessage(p.pool.QueryRow(ctx, getMessageQuery, chatId, messageId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.ChatMessage{}, fmt.Errorf("chat message %s: %w", messageId, domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.ChatMessage{}, fmt.Errorf("failed to get chat message: %w", err)
+	}
+	return message, nil
+}
+
+func scanMessage(row pgx.Row) (domain.ChatMessage, error) {
+	var message domain.ChatMessage
+	if err := row.Scan(
+		&message.ID,
+		&message.ParentID,
+		&message.Role,
+		&message.Content,
+		&message.Name,
+		&message.Args,
+		&message.CallID,
+		&message.Result,
+		&message.Cancelled,
+		&message.ChatSessionID,
+		&message.CreatedAt,
+		&message.SiblingIDs,
+	); err != nil {
+		return domain.ChatMessage{}, fmt.Errorf("failed to scan chat message: %w", err)
+	}
+	return message, nil
+}
+
+const setCurrentLeafQuery = `
+UPDATE chats SET current_leaf_id = $2 WHERE id = $1;
+`
+
+func (p *PGXRepository) SetCurrentLeaf(ctx context.Context, chatId, messageId string) error {
+	if _, err := p.pool.Exec(ctx, setCurrentLeafQuery, chatId, messageId); err != nil {
+		return fmt.Errorf("failed to set current leaf: %w", err)
+	}
+	return nil
+}
+
+// selectBranchQuery follows the most recent child of each message, starting
+// at the selected one, and makes the last message reached the current leaf.
+const selectBranchQuery = `
+WITH RECURSIVE descendants AS (
+	SELECT id, 0 AS depth
+	FROM chat_messages
+	WHERE chat_session_id = $1 AND id = $2
+	UNION ALL
+	SELECT child.id, descendants.depth + 1
+	FROM descendants
+	CROSS JOIN LATERAL (
+		SELECT c.id
+		FROM chat_messages c
+		WHERE c.parent_id = descendants.id
+		ORDER BY c.seq DESC
+		LIMIT 1
+	) child
+)
+UPDATE chats
+SET current_leaf_id = (SELECT id FROM descendants ORDER BY depth DESC LIMIT 1)
+WHERE id = $1 AND EXISTS (SELECT 1 FROM descendants);
+`
+
+func (p *PGXRepository) SelectBranch(ctx context.Context, chatId, messageId string) error {
+	if _, err := p.pool.Exec(ctx, selectBranchQuery, chatId, messageId); err != nil {
+		return fmt.Errorf("failed to select branch: %w", err)
+	}
+	return nil
+}
+
 const query = `
 SELECT name
 FROM chats
@@ -97,48 +209,143 @@ func (p *PGXRepository) GetSessionName(ctx context.Context, chatId string) (stri
 	return name, nil
 }
 
+const getSessionQuery = `
+SELECT *
+FROM chats
+WHERE id = $1;
+`
+
+func (p *PGXRepository) GetSession(ctx context.Context, chatId string) (domain.ChatSession, error) {
+	rows, err := p.pool.Query(ctx, getSessionQuery, chatId)
+	if err != nil {
+		return domain.ChatSession{}, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	return collectSession(rows, chatId)
+}
+
+func collectSession(rows pgx.Rows, chatId string) (domain.ChatSession, error) {
+	session, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.ChatSession])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.ChatSession{}, fmt.Errorf("chat %s: %w", chatId, domain.ErrNotFound)
+	}
+	return session, err
+}
+
+const updateSettingsQuery = `
+UPDATE chats
+SET model = $2, temperature = $3, top_p = $4, max_output_tokens = $5, reasoning_effort = $6
+WHERE id = $1
+RETURNING *;
+`
+
+func (p *PGXRepository) UpdateSettings(
+	ctx context.Context,
+	chatId string,
+	settings domain.GenerationSettings,
+) (domain.ChatSession, error) {
+	rows, err := p.pool.Query(
+		ctx,
+		updateSettingsQuery,
+		chatId,
+		settings.Model,
+		settings.Temperature,
+		settings.TopP,
+		settings.MaxOutputTokens,
+		settings.ReasoningEffort,
+	)
+	if err != nil {
+		return domain.ChatSession{}, fmt.Errorf("failed to update settings: %w", err)
+	}
+
+	return collectSession(rows, chatId)
+}
+
+const updateSystemPromptQuery = `
+UPDATE chats
+SET system_prompt = $2
+WHERE id = $1
+RETURNING *;
+`
+
+func (p *PGXRepository) UpdateSystemPrompt(ctx context.Context, chatId, systemPrompt string) (domain.ChatSession, error) {
+	rows, err := p.pool.Query(ctx, updateSystemPromptQuery, chatId, systemPrompt)
+	if err != nil {
+		return domain.ChatSession{}, fmt.Errorf("failed to update system prompt: %w", err)
+	}
+
+	return collectSession(rows, chatId)
+}
+
+// SaveMessage stores the messages as a chain: the first one is attached to its
+// ParentID and each following message to the one before it. The last message
+// becomes the current leaf of the chat.
 func (p *PGXRepository) SaveMessage(ctx context.Context, chatSessionId string, messages ...domain.ChatMessage) error {
 	if len(messages) == 0 {
 		return nil
 	}
 
 	rows := [][]any{}
+	parentId := messages[0].ParentID
 
 	for _, message := range messages {
-		if message.Content == "" {
+		if message.Content == "" && message.Args == nil && message.Result == nil {
 			continue
 		}
+		id := message.ID
+		if id == "" {
+			id = uuid.New().String()
+		}
 		rows = append(rows, []any{
+			id,
+			parentId,
 			message.Role,
 			message.Content,
 			message.Name,
 			message.Args,
 			message.CallID,
 			message.Result,
+			message.Cancelled,
 			chatSessionId,
 		})
+		parentId = &id
+	}
+
+	if len(rows) == 0 {
+		return nil
 	}
 
-	_, err := p.pool.CopyFrom(
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.CopyFrom(
 		ctx,
 		pgx.Identifier([]string{"chat_messages"}),
-		[]string{"role", "content", "name", "args", "call_id", "result", "chat_session_id"},
+		[]string{"id", "parent_id", "role", "content", "name", "args", "call_id", "result", "cancelled", "chat_session_id"},
 		pgx.CopyFromRows(rows),
-	)
-	if err != nil {
+	); err != nil {
 		return fmt.Errorf("failed to save chat messages: %w", err)
 	}
 
-	return nil
+	if _, err := tx.Exec(ctx, setCurrentLeafQuery, chatSessionId, *parentId); err != nil {
+		return fmt.Errorf("failed to set current leaf: %w", err)
+	}
+
+	return tx.Commit(ctx)
 }
 
 const listSessionsQuery = `
 SELECT *
-FROM chats;
+FROM chats
+WHERE workspace_id = $1
+ORDER BY created_at;
 `
 
-func (p *PGXRepository) ListSessions(ctx context.Context) ([]domain.ChatSession, error) {
-	rows, err := p.pool.Query(ctx, listSessionsQuery)
+func (p *PGXRepository) ListSessions(ctx context.Context, workspaceId string) ([]domain.ChatSession, error) {
+	rows, err := p.pool.Query(ctx, listSessionsQuery, workspaceId)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+var _ domain.RunRegistry = &Runs{}
+
+// Runs cancels runs through the pubsub, so a cancellation reaches the run
+// whichever instance is processing it. Each run listens on the cancel topic of
+// its chat while it's tracked.
+type Runs struct {
+	pubsub domain.PubSub[domain.ChatEvent]
+}
+
+func NewRuns(pubsub domain.PubSub[domain.ChatEvent]) *Runs {
+	return &Runs{
+		pubsub: pubsub,
+	}
+}
+
+// cancelTopic is kept apart from the chat's topic, so viewers don't receive
+// the cancellations.
+func cancelTopic(chatId string) string {
+	return "cancel:" + chatId
+}
+
+func (r *Runs) Track(ctx context.Context, chatId string) (context.Context, func()) {
+	runCtx, cancel := context.WithCancelCause(ctx)
+
+	subscription, err := r.pubsub.Subscribe(cancelTopic(chatId), domain.SubscribeOptions{BufferSize: 1})
+	if err != nil {
+		log.Errorf("failed to subscribe to cancellations of chat %s: %v", chatId, err)
+		return runCtx, func() { cancel(nil) }
+	}
+
+	go func() {
+		select {
+		case _, ok := <-subscription.Messages:
+			if ok {
+				cancel(domain.ErrRunCancelled)
+			}
+		case <-runCtx.Done():
+		}
+	}()
+
+	return runCtx, func() {
+		cancel(nil)
+		subscription.Unsubscribe()
+	}
+}
+
+func (r *Runs) Cancel(chatId string) error {
+	if err := r.pubsub.Publish(cancelTopic(chatId), domain.ChatEvent{
+		Type:          "cancel",
+		ChatSessionID: chatId,
+	}); err != nil {
+		return fmt.Errorf("failed to publish cancellation: %w", err)
+	}
+	return nil
+}
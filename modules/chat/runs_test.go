@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/pubsub"
+)
+
+func TestRunsCancelReachesOtherInstances(t *testing.T) {
+	shared := pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+	worker, web := NewRuns(shared), NewRuns(shared)
+
+	runCtx, done := worker.Track(context.Background(), "chat-1")
+	defer done()
+	otherCtx, otherDone := worker.Track(context.Background(), "chat-2")
+	defer otherDone()
+
+	if err := web.Cancel("chat-1"); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+
+	select {
+	case <-runCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("run wasn't cancelled")
+	}
+	if cause := context.Cause(runCtx); !errors.Is(cause, domain.ErrRunCancelled) {
+		t.Errorf("got cause %v, want ErrRunCancelled", cause)
+	}
+	if otherCtx.Err() != nil {
+		t.Error("the run of another chat was cancelled")
+	}
+}
+
+func TestRunsDoneStopsListening(t *testing.T) {
+	shared := pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+	runs := NewRuns(shared)
+
+	runCtx, done := runs.Track(context.Background(), "chat-1")
+	done()
+
+	if err := runs.Cancel("chat-1"); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if cause := context.Cause(runCtx); errors.Is(cause, domain.ErrRunCancelled) {
+		t.Error("a finished run was cancelled")
+	}
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"sync"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// chatScheduler hands jobs to the workers so that a chat never has more than
+// one job running. Jobs for a chat that is busy wait, in order, until the
+// running one is done.
+type chatScheduler struct {
+	ready chan<- domain.MessageJob
+	// waiting has an entry for every chat with a running job.
+	waiting map[string][]domain.MessageJob
+	mu      sync.Mutex
+}
+
+// newChatScheduler expects ready to have room for every job that can be
+// scheduled at once, so that handing a job out never blocks.
+func newChatScheduler(ready chan<- domain.MessageJob) *chatScheduler {
+	return &chatScheduler{
+		ready:   ready,
+		waiting: map[string][]domain.MessageJob{},
+	}
+}
+
+func (s *chatScheduler) schedule(job domain.MessageJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if waiting, busy := s.waiting[job.ChatSessionID]; busy {
+		s.waiting[job.ChatSessionID] = append(waiting, job)
+		return
+	}
+
+	s.waiting[job.ChatSessionID] = []domain.MessageJob{}
+	s.ready <- job
+}
+
+func (s *chatScheduler) done(job domain.MessageJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiting := s.waiting[job.ChatSessionID]
+	if len(waiting) == 0 {
+		delete(s.waiting, job.ChatSessionID)
+		return
+	}
+
+	s.waiting[job.ChatSessionID] = waiting[1:]
+	s.ready <- waiting[0]
+}
+
+func (s *chatScheduler) waitingJobs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, waiting := range s.waiting {
+		count += len(waiting)
+	}
+	return count
+}
@@ -2,61 +2,181 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
 
 	"github.com/raphael-foliveira/htmbot/domain"
 )
 
 var _ domain.ChatService = &Service{}
 
+const messagesPageSize = 50
+
 type Service struct {
 	repository domain.ChatRepository
 	pubsub     domain.PubSub[domain.ChatEvent]
 	enqueuer   domain.MessageEnqueuer
+	runs       domain.RunRegistry
+	snapshots  domain.ResponseSnapshots
+	workspaces domain.WorkspaceService
+	settings   domain.SettingsValidator
 }
 
 func NewService(
 	repository domain.ChatRepository,
 	pubsub domain.PubSub[domain.ChatEvent],
 	enqueuer domain.MessageEnqueuer,
+	runs domain.RunRegistry,
+	snapshots domain.ResponseSnapshots,
+	workspaces domain.WorkspaceService,
+	settings domain.SettingsValidator,
 ) *Service {
 	return &Service{
 		repository: repository,
 		pubsub:     pubsub,
 		enqueuer:   enqueuer,
+		runs:       runs,
+		snapshots:  snapshots,
+		workspaces: workspaces,
+		settings:   settings,
 	}
 }
 
-func (s *Service) ListSessions(ctx context.Context) ([]domain.ChatSession, error) {
-	return s.repository.ListSessions(ctx)
+func (s *Service) ListSessions(ctx context.Context, workspaceId string) ([]domain.ChatSession, error) {
+	return s.repository.ListSessions(ctx, workspaceId)
+}
+
+func (s *Service) CreateChat(
+	ctx context.Context,
+	workspaceId, userId, name, systemPrompt string,
+) (domain.ChatSession, error) {
+	return s.repository.CreateChat(ctx, workspaceId, userId, name, systemPrompt)
 }
 
-func (s *Service) CreateChat(ctx context.Context, name string) (domain.ChatSession, error) {
-	return s.repository.CreateChat(ctx, name)
+// AuthorizeChat reports chats in workspaces the user isn't a member of as not
+// found, so their IDs can't be probed. IDs that aren't UUIDs can't belong to
+// any chat and are rejected before Postgres fails to parse them.
+func (s *Service) AuthorizeChat(
+	ctx context.Context,
+	userId, chatId, role string,
+) (domain.WorkspaceMembership, error) {
+	if err := uuid.Validate(chatId); err != nil {
+		return domain.WorkspaceMembership{}, fmt.Errorf("chat %s: %w", chatId, domain.ErrNotFound)
+	}
+
+	session, err := s.repository.GetSession(ctx, chatId)
+	if err != nil {
+		return domain.WorkspaceMembership{}, err
+	}
+
+	if session.WorkspaceID == nil {
+		return domain.WorkspaceMembership{}, fmt.Errorf("chat %s: %w", chatId, domain.ErrNotFound)
+	}
+
+	membership, err := s.workspaces.GetMembership(ctx, *session.WorkspaceID, userId)
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.WorkspaceMembership{}, fmt.Errorf("chat %s: %w", chatId, domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.WorkspaceMembership{}, fmt.Errorf("failed to get membership: %w", err)
+	}
+
+	if !membership.Allows(role) {
+		return membership, domain.ErrAccessDenied
+	}
+
+	return membership, nil
 }
 
-func (s *Service) GetChatPageData(ctx context.Context, chatId string) (domain.ChatPageData, error) {
+// GetChatPageData returns the page of the path that ends at leafId, or of the
+// current branch when leafId is empty. The chat's current leaf isn't changed.
+func (s *Service) GetChatPageData(ctx context.Context, chatId, leafId string) (domain.ChatPageData, error) {
+	// The snapshot is read first so that a response finishing meanwhile is
+	// found in the messages rather than lost between the two reads. It
+	// continues the current branch, so it's left out of other paths.
+	var inFlight *domain.ResponseSnapshot
+	if snapshot, ok := s.snapshots.Get(chatId); ok && leafId == "" {
+		inFlight = &snapshot
+	}
+
 	chatMessages, err := s.repository.GetMessages(ctx, domain.GetMessagesParams{
 		ChatSessionId: chatId,
-		Limit:         100,
+		LeafID:        leafId,
+		Limit:         messagesPageSize,
 	})
 	if err != nil {
 		return domain.ChatPageData{}, fmt.Errorf("failed to get messages: %w", err)
 	}
 
-	chatName, err := s.repository.GetSessionName(ctx, chatId)
+	session, err := s.repository.GetSession(ctx, chatId)
 	if err != nil {
-		return domain.ChatPageData{}, fmt.Errorf("failed to get session name: %w", err)
+		return domain.ChatPageData{}, fmt.Errorf("failed to get session: %w", err)
 	}
 
 	return domain.ChatPageData{
-		Name:     chatName,
-		Messages: chatMessages,
+		Name:         session.Name,
+		SystemPrompt: session.SystemPrompt,
+		Settings:     session.GenerationSettings,
+		Messages:     chatMessages,
+		InFlight:     inFlight,
 	}, nil
 }
 
+// GetOlderMessages returns the page of the active path that precedes the given
+// message.
+func (s *Service) GetOlderMessages(ctx context.Context, chatId, beforeMessageId string) ([]domain.ChatMessage, error) {
+	message, err := s.repository.GetMessage(ctx, chatId, beforeMessageId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+
+	if message.ParentID == nil {
+		return []domain.ChatMessage{}, nil
+	}
+
+	return s.repository.GetMessages(ctx, domain.GetMessagesParams{
+		ChatSessionId: chatId,
+		LeafID:        *message.ParentID,
+		Limit:         messagesPageSize,
+	})
+}
+
+// ensureIdle returns ErrChatBusy while a response is pending for the chat. A
+// message sent meanwhile would branch off next to the pending response, which
+// then becomes the current leaf and leaves the new message off the active path.
+func (s *Service) ensureIdle(ctx context.Context, chatId string) error {
+	pending, err := s.enqueuer.HasPendingJob(ctx, chatId)
+	if err != nil {
+		return fmt.Errorf("failed to check pending jobs: %w", err)
+	}
+	if pending {
+		return domain.ErrChatBusy
+	}
+	return nil
+}
+
+// SendMessage continues the current branch. It returns ErrChatBusy while the
+// previous message is still being answered.
 func (s *Service) SendMessage(ctx context.Context, chatId, text string) error {
-	newMessage := domain.ChatMessage{Role: "user", Content: text}
+	if err := s.ensureIdle(ctx, chatId); err != nil {
+		return err
+	}
+
+	session, err := s.repository.GetSession(ctx, chatId)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %w", err)
+	}
+
+	newMessage := domain.ChatMessage{
+		ID:            uuid.New().String(),
+		ParentID:      session.CurrentLeafID,
+		Role:          "user",
+		Content:       text,
+		ChatSessionID: chatId,
+	}
 
 	if err := s.repository.SaveMessage(ctx, chatId, newMessage); err != nil {
 		return fmt.Errorf("failed to save user message: %w", err)
@@ -70,17 +190,149 @@ func (s *Service) SendMessage(ctx context.Context, chatId, text string) error {
 		return fmt.Errorf("failed to publish user message: %w", err)
 	}
 
-	if err := s.enqueuer.EnqueueUserMessage(ctx, chatId, text); err != nil {
+	if err := s.enqueuer.EnqueueUserMessage(ctx, chatId, newMessage); err != nil {
+		return fmt.Errorf("failed to enqueue user message: %w", err)
+	}
+
+	return nil
+}
+
+// EditMessage creates a new user message next to the edited one, so the
+// original conversation is kept as a separate branch. The new message is
+// published with its siblings, which tells viewers it starts a new branch.
+func (s *Service) EditMessage(ctx context.Context, chatId, messageId, text string) error {
+	if err := s.ensureIdle(ctx, chatId); err != nil {
+		return err
+	}
+
+	original, err := s.repository.GetMessage(ctx, chatId, messageId)
+	if err != nil {
+		return fmt.Errorf("failed to get message: %w", err)
+	}
+
+	if original.Role != "user" {
+		return fmt.Errorf("only user messages can be edited")
+	}
+
+	newMessage := domain.ChatMessage{
+		ID:            uuid.New().String(),
+		ParentID:      original.ParentID,
+		Role:          "user",
+		Content:       text,
+		ChatSessionID: chatId,
+	}
+
+	if err := s.repository.SaveMessage(ctx, chatId, newMessage); err != nil {
+		return fmt.Errorf("failed to save edited message: %w", err)
+	}
+
+	newMessage.SiblingIDs = append(slices.Clone(original.SiblingIDs), newMessage.ID)
+	if err := s.pubsub.Publish(chatId, domain.ChatEvent{
+		Type:          "message",
+		ChatSessionID: chatId,
+		OfMessage:     newMessage,
+	}); err != nil {
+		return fmt.Errorf("failed to publish edited message: %w", err)
+	}
+
+	if err := s.enqueuer.EnqueueUserMessage(ctx, chatId, newMessage); err != nil {
+		return fmt.Errorf("failed to enqueue edited message: %w", err)
+	}
+
+	return nil
+}
+
+// RegenerateMessage moves the chat back to the user message that prompted the
+// given response and enqueues it again, so the new response becomes a sibling
+// of the old one.
+func (s *Service) RegenerateMessage(ctx context.Context, chatId, messageId string) error {
+	if err := s.ensureIdle(ctx, chatId); err != nil {
+		return err
+	}
+
+	path, err := s.repository.GetMessages(ctx, domain.GetMessagesParams{
+		ChatSessionId: chatId,
+		LeafID:        messageId,
+		Limit:         100,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	var userMessage *domain.ChatMessage
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Role == "user" {
+			userMessage = &path[i]
+			break
+		}
+	}
+	if userMessage == nil {
+		return fmt.Errorf("no user message to regenerate from")
+	}
+
+	if err := s.repository.SetCurrentLeaf(ctx, chatId, userMessage.ID); err != nil {
+		return fmt.Errorf("failed to set current leaf: %w", err)
+	}
+
+	if err := s.enqueuer.EnqueueUserMessage(ctx, chatId, *userMessage); err != nil {
 		return fmt.Errorf("failed to enqueue user message: %w", err)
 	}
 
 	return nil
 }
 
+func (s *Service) SelectBranch(ctx context.Context, chatId, messageId string) error {
+	return s.repository.SelectBranch(ctx, chatId, messageId)
+}
+
 func (s *Service) DeleteChat(ctx context.Context, chatId string) error {
 	return s.repository.DeleteSession(ctx, chatId)
 }
 
-func (s *Service) SubscribeToMessages(chatId string) (chan domain.ChatEvent, func(), error) {
-	return s.pubsub.Subscribe(chatId)
+// ValidateSettings checks the settings against the provider of the agent that
+// generates the chat's responses.
+func (s *Service) ValidateSettings(settings domain.GenerationSettings) error {
+	return s.settings.ValidateSettings(settings)
+}
+
+func (s *Service) UpdateChatSettings(
+	ctx context.Context,
+	chatId string,
+	settings domain.GenerationSettings,
+) (domain.ChatSession, error) {
+	if err := s.ValidateSettings(settings); err != nil {
+		return domain.ChatSession{}, err
+	}
+
+	return s.repository.UpdateSettings(ctx, chatId, settings)
+}
+
+func (s *Service) UpdateSystemPrompt(ctx context.Context, chatId, systemPrompt string) (domain.ChatSession, error) {
+	return s.repository.UpdateSystemPrompt(ctx, chatId, systemPrompt)
+}
+
+// CancelGeneration stops the response being generated for the chat, on
+// whichever instance is generating it. It returns ErrNotFound when no response
+// is being generated.
+func (s *Service) CancelGeneration(ctx context.Context, chatId string) error {
+	if _, ok := s.snapshots.Get(chatId); !ok {
+		return fmt.Errorf("no response is being generated for chat %s: %w", chatId, domain.ErrNotFound)
+	}
+	return s.runs.Cancel(chatId)
+}
+
+// GetInFlightResponse returns the response being streamed to the chat, if
+// one is being generated.
+func (s *Service) GetInFlightResponse(chatId string) (domain.ResponseSnapshot, bool) {
+	return s.snapshots.Get(chatId)
+}
+
+// SubscribeToMessages drops the oldest buffered events when the subscriber
+// falls behind, the subscriber is expected to resync when it misses events. A
+// non-zero lastEventId replays the events published after it.
+func (s *Service) SubscribeToMessages(chatId string, lastEventId int64) (domain.Subscription[domain.ChatEvent], error) {
+	return s.pubsub.Subscribe(chatId, domain.SubscribeOptions{
+		Policy: domain.DropOldest,
+		After:  lastEventId,
+	})
 }
@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/pubsub"
+)
+
+// fakeRepository stores the saved messages of a single chat. The methods it
+// doesn't override panic, through the nil embedded interface.
+type fakeRepository struct {
+	domain.ChatRepository
+	session domain.ChatSession
+	saved   []domain.ChatMessage
+}
+
+func (r *fakeRepository) GetSession(ctx context.Context, chatId string) (domain.ChatSession, error) {
+	return r.session, nil
+}
+
+func (r *fakeRepository) GetMessages(ctx context.Context, params domain.GetMessagesParams) ([]domain.ChatMessage, error) {
+	return slices.Clone(r.saved), nil
+}
+
+func (r *fakeRepository) GetMessage(ctx context.Context, chatId, messageId string) (domain.ChatMessage, error) {
+	for _, message := range r.saved {
+		if message.ID == messageId {
+			message.SiblingIDs = []string{message.ID}
+			return message, nil
+		}
+	}
+	return domain.ChatMessage{}, domain.ErrNotFound
+}
+
+func (r *fakeRepository) SaveMessage(ctx context.Context, sessionId string, messages ...domain.ChatMessage) error {
+	r.saved = append(r.saved, messages...)
+	if len(messages) > 0 {
+		r.session.CurrentLeafID = &messages[len(messages)-1].ID
+	}
+	return nil
+}
+
+func TestServiceSendMessageWaitsForPendingResponse(t *testing.T) {
+	repository := &fakeRepository{session: domain.ChatSession{ID: "chat-1"}}
+	queue := NewInMemoryQueue(10)
+	publisher := pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+	service := NewService(repository, publisher, queue, NewRuns(publisher), NewSnapshots(), nil, nil)
+	ctx := context.Background()
+
+	if err := service.SendMessage(ctx, "chat-1", "first"); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	if err := service.SendMessage(ctx, "chat-1", "second"); !errors.Is(err, domain.ErrChatBusy) {
+		t.Fatalf("got error %v while the first message is pending, want ErrChatBusy", err)
+	}
+	if len(repository.saved) != 1 {
+		t.Fatalf("got %d saved messages, want only the first", len(repository.saved))
+	}
+
+	job, err := queue.DequeueUserMessage(ctx)
+	if err != nil {
+		t.Fatalf("DequeueUserMessage failed: %v", err)
+	}
+	response := domain.ChatMessage{ID: "response-1", ParentID: &job.MessageID, Role: "assistant"}
+	repository.SaveMessage(ctx, "chat-1", response)
+	if err := queue.CompleteJob(ctx, job.ID); err != nil {
+		t.Fatalf("CompleteJob failed: %v", err)
+	}
+
+	if err := service.SendMessage(ctx, "chat-1", "second"); err != nil {
+		t.Fatalf("SendMessage failed once the response was saved: %v", err)
+	}
+	second := repository.saved[len(repository.saved)-1]
+	if second.ParentID == nil || *second.ParentID != response.ID {
+		t.Errorf("second message has parent %v, want the response %s", second.ParentID, response.ID)
+	}
+}
+
+func TestServiceEditMessagePublishesNewBranch(t *testing.T) {
+	original := domain.ChatMessage{ID: "message-1", Role: "user", Content: "first"}
+	repository := &fakeRepository{
+		session: domain.ChatSession{ID: "chat-1"},
+		saved:   []domain.ChatMessage{original},
+	}
+	publisher := pubsub.NewChannel[domain.ChatEvent](pubsub.ChannelConfig{})
+	service := NewService(repository, publisher, NewInMemoryQueue(10), NewRuns(publisher), NewSnapshots(), nil, nil)
+
+	subscription, err := service.SubscribeToMessages("chat-1", 0)
+	if err != nil {
+		t.Fatalf("SubscribeToMessages failed: %v", err)
+	}
+	defer subscription.Unsubscribe()
+
+	if err := service.EditMessage(context.Background(), "chat-1", original.ID, "edited"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+
+	select {
+	case event := <-subscription.Messages:
+		message := event.Message.OfMessage
+		if event.Message.Type != "message" || message.Content != "edited" || message.Role != "user" {
+			t.Errorf("got event %+v, want the edited message", event.Message)
+		}
+		if len(message.SiblingIDs) != 2 || message.SiblingIDs[0] != original.ID || message.SiblingIDs[1] != message.ID {
+			t.Errorf("got siblings %v, want the original and the edited message", message.SiblingIDs)
+		}
+	default:
+		t.Fatal("no event was published")
+	}
+}
+
+func TestServiceAuthorizeChatRejectsMalformedIDs(t *testing.T) {
+	// Any query panics through the nil repository, the IDs must be rejected
+	// before one is made.
+	service := NewService(struct{ domain.ChatRepository }{}, nil, nil, nil, nil, nil, nil)
+
+	for _, chatId := range []string{"", "not-a-uuid", "1234", "00000000-0000-0000-0000-00000000000g"} {
+		_, err := service.AuthorizeChat(context.Background(), "user-1", chatId, domain.WorkspaceViewer)
+		if !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("AuthorizeChat(%q) returned %v, want ErrNotFound", chatId, err)
+		}
+	}
+}
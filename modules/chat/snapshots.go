@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+var (
+	_ domain.ResponseSnapshots = &Snapshots{}
+	_ domain.ResponseSnapshots = &PGXSnapshots{}
+)
+
+// Snapshots keeps the responses being streamed by this process, one per chat.
+// They're only visible to this process, so it only fits a single instance.
+type Snapshots struct {
+	snapshots map[string]domain.ResponseSnapshot
+	mu        sync.RWMutex
+}
+
+func NewSnapshots() *Snapshots {
+	return &Snapshots{
+		snapshots: map[string]domain.ResponseSnapshot{},
+	}
+}
+
+func (s *Snapshots) Start(chatId, deltaId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[chatId] = domain.ResponseSnapshot{ID: deltaId}
+}
+
+func (s *Snapshots) Update(chatId string, seq int, delta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, ok := s.snapshots[chatId]
+	if !ok {
+		return
+	}
+	snapshot.Text += delta
+	snapshot.Seq = seq
+	s.snapshots[chatId] = snapshot
+}
+
+func (s *Snapshots) Finish(chatId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, chatId)
+}
+
+func (s *Snapshots) Get(chatId string) (domain.ResponseSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, ok := s.snapshots[chatId]
+	return snapshot, ok
+}
+
+const pgxSnapshotTimeout = 5 * time.Second
+
+type PGXSnapshotsConfig struct {
+	// StaleAfter is how long a snapshot is kept without being updated. A run
+	// that crashed or was handed out again leaves its snapshot behind, which
+	// would otherwise be shown as in flight forever. It should be the
+	// visibility timeout of the queue.
+	StaleAfter time.Duration
+}
+
+func (c *PGXSnapshotsConfig) ApplyDefaults() {
+	if c.StaleAfter == 0 {
+		c.StaleAfter = 10 * time.Minute
+	}
+}
+
+// PGXSnapshots keeps the snapshots in the response_snapshots table, so a
+// viewer connected to any instance sees the response being streamed by
+// another. Failing to store a snapshot only affects late joiners, so errors
+// are logged instead of failing the response.
+type PGXSnapshots struct {
+	pool   *pgxpool.Pool
+	config PGXSnapshotsConfig
+}
+
+func NewPGXSnapshots(pool *pgxpool.Pool, config PGXSnapshotsConfig) *PGXSnapshots {
+	config.ApplyDefaults()
+	return &PGXSnapshots{
+		pool:   pool,
+		config: config,
+	}
+}
+
+// startSnapshotQuery also clears out the snapshots left behind by runs that
+// never finished.
+const startSnapshotQuery = `
+WITH stale AS (
+	DELETE FROM response_snapshots
+	WHERE updated_at < NOW() - make_interval(secs => $3)
+		AND chat_session_id <> $1
+)
+INSERT INTO response_snapshots (chat_session_id, delta_id)
+VALUES ($1, $2)
+ON CONFLICT (chat_session_id) DO UPDATE
+SET delta_id = EXCLUDED.delta_id,
+	text = '',
+	seq = 0,
+	updated_at = NOW();
+`
+
+func (s *PGXSnapshots) Start(chatId, deltaId string) {
+	s.exec("start", startSnapshotQuery, chatId, deltaId, s.config.StaleAfter.Seconds())
+}
+
+// updateSnapshotQuery only appends the delta, so writing a snapshot doesn't
+// grow with the length of the response.
+const updateSnapshotQuery = `
+UPDATE response_snapshots
+SET text = text || $3, seq = $2, updated_at = NOW()
+WHERE chat_session_id = $1;
+`
+
+func (s *PGXSnapshots) Update(chatId string, seq int, delta string) {
+	s.exec("update", updateSnapshotQuery, chatId, seq, delta)
+}
+
+const finishSnapshotQuery = `
+DELETE FROM response_snapshots WHERE chat_session_id = $1;
+`
+
+func (s *PGXSnapshots) Finish(chatId string) {
+	s.exec("finish", finishSnapshotQuery, chatId)
+}
+
+const getSnapshotQuery = `
+SELECT delta_id, text, seq
+FROM response_snapshots
+WHERE chat_session_id = $1
+	AND updated_at >= NOW() - make_interval(secs => $2);
+`
+
+func (s *PGXSnapshots) Get(chatId string) (domain.ResponseSnapshot, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgxSnapshotTimeout)
+	defer cancel()
+
+	snapshot := domain.ResponseSnapshot{}
+	err := s.pool.QueryRow(ctx, getSnapshotQuery, chatId, s.config.StaleAfter.Seconds()).Scan(&snapshot.ID, &snapshot.Text, &snapshot.Seq)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Errorf("failed to get response snapshot: %v", err)
+		}
+		return domain.ResponseSnapshot{}, false
+	}
+	return snapshot, true
+}
+
+func (s *PGXSnapshots) exec(action, query string, args ...any) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgxSnapshotTimeout)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, query, args...); err != nil {
+		log.Errorf("failed to %s response snapshot: %v", action, err)
+	}
+}
@@ -3,10 +3,18 @@ package chat
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/raphael-foliveira/htmbot/domain"
 	"github.com/raphael-foliveira/htmbot/platform/agents"
 )
 
+// Tools returns the tools available to the agent.
+func Tools() []domain.LLMTool {
+	return []domain.LLMTool{NewTestTool()}
+}
+
 func NewTestTool() *agents.LLMTool {
 	return agents.NewLLMTool(
 		"test-tool",
@@ -29,3 +37,43 @@ func NewTestTool() *agents.LLMTool {
 		},
 	)
 }
+
+// observedTool wraps a tool and reports every execution to onStart and
+// onFinish, so tool activity can be published while the agent is running.
+type observedTool struct {
+	domain.LLMTool
+	onStart  func(domain.ToolCallEvent)
+	onFinish func(domain.ToolCallEvent)
+}
+
+func newObservedTool(
+	tool domain.LLMTool,
+	onStart func(domain.ToolCallEvent),
+	onFinish func(domain.ToolCallEvent),
+) *observedTool {
+	return &observedTool{
+		LLMTool:  tool,
+		onStart:  onStart,
+		onFinish: onFinish,
+	}
+}
+
+func (t *observedTool) Execute(ctx context.Context, args string) (string, error) {
+	event := domain.ToolCallEvent{
+		ID:   uuid.New().String(),
+		Name: t.Name(),
+		Args: args,
+	}
+	t.onStart(event)
+
+	start := time.Now()
+	result, err := t.LLMTool.Execute(ctx, args)
+	event.Duration = time.Since(start)
+	event.Result = result
+	if err != nil {
+		event.Error = err.Error()
+	}
+	t.onFinish(event)
+
+	return result, err
+}
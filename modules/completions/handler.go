@@ -0,0 +1,369 @@
+package completions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+const defaultModelName = "htmbot"
+
+type HandlerConfig struct {
+	// Record stores every exchange as a chat session, unless the request sets
+	// store to false.
+	Record bool
+}
+
+// Handler serves an OpenAI compatible chat completions endpoint, so OpenAI
+// clients can be pointed at the app with a base URL ending in /v1.
+type Handler struct {
+	service domain.CompletionService
+	config  HandlerConfig
+}
+
+func NewHandler(service domain.CompletionService, config HandlerConfig) *Handler {
+	return &Handler{
+		service: service,
+		config:  config,
+	}
+}
+
+func (h *Handler) Register(e *echo.Echo, middleware ...echo.MiddlewareFunc) {
+	g := e.Group("/v1", middleware...)
+	g.POST("/chat/completions", h.createCompletion, httpx.RequireScope(domain.ScopeSend))
+}
+
+type completionRequest struct {
+	Model               string              `json:"model"`
+	Messages            []completionMessage `json:"messages"`
+	Stream              bool                `json:"stream"`
+	Store               *bool               `json:"store"`
+	Temperature         *float64            `json:"temperature"`
+	TopP                *float64            `json:"top_p"`
+	MaxTokens           *int64              `json:"max_tokens"`
+	MaxCompletionTokens *int64              `json:"max_completion_tokens"`
+	ReasoningEffort     string              `json:"reasoning_effort"`
+}
+
+type completionMessage struct {
+	Role       string               `json:"role"`
+	Content    json.RawMessage      `json:"content"`
+	ToolCalls  []completionToolCall `json:"tool_calls"`
+	ToolCallID string               `json:"tool_call_id"`
+}
+
+type completionToolCall struct {
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type contentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type completionResponse struct {
+	ID            string             `json:"id"`
+	Object        string             `json:"object"`
+	Created       int64              `json:"created"`
+	Model         string             `json:"model"`
+	Choices       []completionChoice `json:"choices"`
+	ChatSessionID string             `json:"chat_session_id,omitempty"`
+}
+
+type completionChoice struct {
+	Index        int             `json:"index"`
+	Message      responseMessage `json:"message"`
+	FinishReason string          `json:"finish_reason"`
+}
+
+type responseMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type completionChunk struct {
+	ID            string        `json:"id"`
+	Object        string        `json:"object"`
+	Created       int64         `json:"created"`
+	Model         string        `json:"model"`
+	Choices       []chunkChoice `json:"choices"`
+	ChatSessionID string        `json:"chat_session_id,omitempty"`
+}
+
+type chunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        chunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+type chunkDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func invalidRequest(c echo.Context, message string) error {
+	return c.JSON(http.StatusBadRequest, errorResponse{
+		Error: errorBody{Message: message, Type: "invalid_request_error"},
+	})
+}
+
+func (h *Handler) createCompletion(c echo.Context) error {
+	var body completionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return invalidRequest(c, fmt.Sprintf("invalid request body: %s", err))
+	}
+
+	request, err := h.parseRequest(body)
+	if err != nil {
+		return invalidRequest(c, err.Error())
+	}
+	user, _ := domain.UserFromContext(c.Request().Context())
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+	request.UserID = user.ID
+	request.WorkspaceID = workspace.ID
+
+	if request.Record && !workspace.Allows(domain.WorkspaceEditor) {
+		return c.JSON(http.StatusForbidden, errorResponse{
+			Error: errorBody{
+				Message: "storing completions requires the editor role, set store to false",
+				Type:    "permission_error",
+			},
+		})
+	}
+
+	model := body.Model
+	if model == "" {
+		model = defaultModelName
+	}
+
+	if body.Stream {
+		return h.streamCompletion(c, request, model)
+	}
+
+	completion, err := h.service.Complete(c.Request().Context(), request)
+	if err != nil {
+		log.Errorf("failed to complete chat: %v", err)
+		return c.JSON(http.StatusInternalServerError, errorResponse{
+			Error: errorBody{Message: "failed to generate a response", Type: "server_error"},
+		})
+	}
+
+	return c.JSON(http.StatusOK, completionResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []completionChoice{{
+			Message:      responseMessage{Role: "assistant", Content: completion.Text()},
+			FinishReason: "stop",
+		}},
+		ChatSessionID: completion.ChatSessionID,
+	})
+}
+
+// streamCompletion streams the response as chunks on data-only events,
+// terminated by [DONE]. Errors that happen once the stream has started are
+// sent as an error object in place of a chunk.
+func (h *Handler) streamCompletion(c echo.Context, request domain.CompletionRequest, model string) error {
+	httpx.SetupSSE(c)
+
+	chunk := completionChunk{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   model,
+	}
+	writeChunk := func(delta chunkDelta, finishReason *string) error {
+		chunk.Choices = []chunkChoice{{Delta: delta, FinishReason: finishReason}}
+		return writeData(c, chunk)
+	}
+
+	if err := writeChunk(chunkDelta{Role: "assistant"}, nil); err != nil {
+		return err
+	}
+
+	completion, err := h.service.StreamCompletion(c.Request().Context(), request, func(delta string) {
+		if err := writeChunk(chunkDelta{Content: delta}, nil); err != nil {
+			log.Errorf("failed to write completion chunk: %v", err)
+		}
+	})
+	if err != nil {
+		log.Errorf("failed to stream chat completion: %v", err)
+		if err := writeData(c, errorResponse{
+			Error: errorBody{Message: "failed to generate a response", Type: "server_error"},
+		}); err != nil {
+			return err
+		}
+	} else {
+		stop := "stop"
+		chunk.ChatSessionID = completion.ChatSessionID
+		if err := writeChunk(chunkDelta{}, &stop); err != nil {
+			return err
+		}
+	}
+
+	if err := httpx.WriteEventStream(c.Response(), "", "", "[DONE]"); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+func writeData(c echo.Context, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk: %w", err)
+	}
+
+	if err := httpx.WriteEventStream(c.Response(), "", "", string(encoded)); err != nil {
+		return err
+	}
+
+	c.Response().Flush()
+	return nil
+}
+
+func (h *Handler) parseRequest(body completionRequest) (domain.CompletionRequest, error) {
+	request := domain.CompletionRequest{
+		Settings: domain.GenerationSettings{
+			Temperature:     body.Temperature,
+			TopP:            body.TopP,
+			MaxOutputTokens: body.MaxCompletionTokens,
+			ReasoningEffort: body.ReasoningEffort,
+		},
+		Record: h.config.Record,
+	}
+	// The default model name stands for the model the agent is configured
+	// with.
+	if body.Model != defaultModelName {
+		request.Settings.Model = body.Model
+	}
+	if request.Settings.MaxOutputTokens == nil {
+		request.Settings.MaxOutputTokens = body.MaxTokens
+	}
+	if body.Store != nil {
+		request.Record = *body.Store
+	}
+	if err := h.service.ValidateSettings(request.Settings); err != nil {
+		return request, err
+	}
+
+	if len(body.Messages) == 0 {
+		return request, fmt.Errorf("messages must not be empty")
+	}
+
+	messages, err := toChatMessages(body.Messages)
+	if err != nil {
+		return request, err
+	}
+	request.Messages = messages
+
+	return request, nil
+}
+
+// toChatMessages converts the conversation to chat messages. Tool calls made
+// by the client are kept as tool_call and tool_result messages, like the ones
+// the agent produces.
+func toChatMessages(messages []completionMessage) ([]domain.ChatMessage, error) {
+	chatMessages := []domain.ChatMessage{}
+	toolNames := map[string]string{}
+
+	for i, message := range messages {
+		content, err := parseContent(message.Content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content in message %d: %w", i, err)
+		}
+
+		switch message.Role {
+		case "system", "developer":
+			chatMessages = append(chatMessages, domain.ChatMessage{Role: "system", Content: content})
+
+		case "user":
+			chatMessages = append(chatMessages, domain.ChatMessage{Role: "user", Content: content})
+
+		case "assistant":
+			if content != "" {
+				chatMessages = append(chatMessages, domain.ChatMessage{Role: "assistant", Content: content})
+			}
+			for _, toolCall := range message.ToolCalls {
+				name, args, callId := toolCall.Function.Name, toolCall.Function.Arguments, toolCall.ID
+				if args == "" {
+					args = "{}"
+				}
+				toolNames[callId] = name
+				chatMessages = append(chatMessages, domain.ChatMessage{
+					Role:   "tool_call",
+					Name:   &name,
+					Args:   &args,
+					CallID: &callId,
+				})
+			}
+
+		case "tool":
+			callId := message.ToolCallID
+			toolMessage := domain.ChatMessage{
+				Role:   "tool_result",
+				CallID: &callId,
+				Result: &content,
+			}
+			if name, ok := toolNames[callId]; ok {
+				toolMessage.Name = &name
+			}
+			chatMessages = append(chatMessages, toolMessage)
+
+		default:
+			return nil, fmt.Errorf("unsupported role in message %d: %s", i, message.Role)
+		}
+	}
+
+	return chatMessages, nil
+}
+
+// parseContent reads content given either as a string or as a list of parts,
+// of which only text parts are supported.
+func parseContent(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+
+	var parts []contentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("content must be a string or a list of parts")
+	}
+
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type != "text" {
+			return "", fmt.Errorf("unsupported content part: %s", part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+
+	return strings.Join(texts, "\n"), nil
+}
@@ -0,0 +1,183 @@
+package completions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/slicesx"
+)
+
+const chatNameLength = 60
+
+var _ domain.CompletionService = &Service{}
+
+type Service struct {
+	agent      domain.LLMAgent
+	tools      []domain.LLMTool
+	repository domain.ChatRepository
+}
+
+func NewService(agent domain.LLMAgent, tools []domain.LLMTool, repository domain.ChatRepository) *Service {
+	return &Service{
+		agent:      agent,
+		tools:      tools,
+		repository: repository,
+	}
+}
+
+func (s *Service) ValidateSettings(settings domain.GenerationSettings) error {
+	return s.agent.ValidateSettings(settings)
+}
+
+func (s *Service) Complete(ctx context.Context, request domain.CompletionRequest) (domain.Completion, error) {
+	if err := s.ValidateSettings(request.Settings); err != nil {
+		return domain.Completion{}, err
+	}
+
+	response, err := s.agent.GenerateResponse(ctx, request.Messages, s.tools, request.Settings)
+	if err != nil {
+		return domain.Completion{}, fmt.Errorf("failed to generate response: %w", err)
+	}
+
+	return s.complete(ctx, request, response)
+}
+
+func (s *Service) StreamCompletion(
+	ctx context.Context,
+	request domain.CompletionRequest,
+	callback func(delta string),
+) (domain.Completion, error) {
+	if err := s.ValidateSettings(request.Settings); err != nil {
+		return domain.Completion{}, err
+	}
+
+	separator := &turnSeparator{callback: callback}
+	tools := slicesx.Map(s.tools, func(tool domain.LLMTool) domain.LLMTool {
+		return separatedTool{LLMTool: tool, separator: separator}
+	})
+
+	response, err := s.agent.StreamResponse(ctx, request.Messages, tools, request.Settings, separator.write)
+	if err != nil {
+		return domain.Completion{}, fmt.Errorf("failed to stream response: %w", err)
+	}
+
+	return s.complete(ctx, request, response)
+}
+
+// turnSeparator streams the text of each assistant turn separated by a blank
+// line, the way Completion.Text joins them. A turn that's followed by another
+// one ends in tool calls, so the tools mark where it ends.
+type turnSeparator struct {
+	callback func(delta string)
+	mu       sync.Mutex
+	streamed bool
+	ended    bool
+}
+
+func (t *turnSeparator) write(delta string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if delta == "" {
+		return
+	}
+	if t.ended && t.streamed {
+		delta = "\n\n" + delta
+	}
+	t.streamed, t.ended = true, false
+	t.callback(delta)
+}
+
+func (t *turnSeparator) endTurn() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = true
+}
+
+type separatedTool struct {
+	domain.LLMTool
+	separator *turnSeparator
+}
+
+func (t separatedTool) Execute(ctx context.Context, args string) (string, error) {
+	t.separator.endTurn()
+	return t.LLMTool.Execute(ctx, args)
+}
+
+func (s *Service) complete(
+	ctx context.Context,
+	request domain.CompletionRequest,
+	response []domain.ChatMessage,
+) (domain.Completion, error) {
+	completion := domain.Completion{Messages: response}
+	if !request.Record {
+		return completion, nil
+	}
+
+	chatSessionId, err := s.record(ctx, request, response)
+	if err != nil {
+		return domain.Completion{}, err
+	}
+	completion.ChatSessionID = chatSessionId
+
+	return completion, nil
+}
+
+// record stores the exchange as a new chat. The system messages become the
+// chat's system prompt and the rest of the conversation a single branch.
+func (s *Service) record(
+	ctx context.Context,
+	request domain.CompletionRequest,
+	response []domain.ChatMessage,
+) (string, error) {
+	systemPrompts := []string{}
+	conversation := []domain.ChatMessage{}
+	for _, message := range request.Messages {
+		if message.Role == "system" {
+			systemPrompts = append(systemPrompts, message.Content)
+			continue
+		}
+		conversation = append(conversation, message)
+	}
+
+	session, err := s.repository.CreateChat(
+		ctx,
+		request.WorkspaceID,
+		request.UserID,
+		chatName(conversation),
+		strings.Join(systemPrompts, "\n\n"),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat: %w", err)
+	}
+
+	if err := s.repository.SaveMessage(ctx, session.ID, append(conversation, response...)...); err != nil {
+		return "", fmt.Errorf("failed to save messages: %w", err)
+	}
+
+	return session.ID, nil
+}
+
+// chatName names a recorded chat after the first line of its first user
+// message.
+func chatName(messages []domain.ChatMessage) string {
+	for _, message := range messages {
+		if message.Role != "user" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(strings.TrimSpace(message.Content), "\n")
+		if name == "" {
+			continue
+		}
+		if runes := []rune(name); len(runes) > chatNameLength {
+			name = string(runes[:chatNameLength]) + "…"
+		}
+		return name
+	}
+
+	return "Chat completion"
+}
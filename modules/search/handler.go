@@ -1,25 +1,33 @@
 package search
 
 import (
-	"math/rand"
+	"fmt"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
 	searchviews "github.com/raphael-foliveira/htmbot/modules/search/views"
 	"github.com/raphael-foliveira/htmbot/platform/httpx"
 )
 
-type Handler struct{}
+const dateLayout = "2006-01-02"
 
-func NewHandler() *Handler {
-	return &Handler{}
+type Handler struct {
+	service domain.SearchService
 }
 
-func (h *Handler) Register(e *echo.Echo) {
-	g := e.Group("/search")
+func NewHandler(service domain.SearchService) *Handler {
+	return &Handler{
+		service: service,
+	}
+}
 
-	g.GET("", h.Index)
-	g.GET("/results", h.SearchResults)
+func (h *Handler) Register(e *echo.Echo, middleware ...echo.MiddlewareFunc) {
+	g := e.Group("/search", middleware...)
+
+	read := httpx.RequireScope(domain.ScopeRead)
+	g.GET("", h.Index, read)
+	g.GET("/results", h.SearchResults, read)
 }
 
 func (h *Handler) Index(c echo.Context) error {
@@ -27,16 +35,43 @@ func (h *Handler) Index(c echo.Context) error {
 }
 
 func (h *Handler) SearchResults(c echo.Context) error {
-	query := c.QueryParam("query")
-
-	if query == "" {
-		return httpx.Render(c, searchviews.SearchResults([]string{}))
+	params, err := parseSearchParams(c)
+	if err != nil {
+		return httpx.Render(c, searchviews.SearchError(err))
 	}
 
-	resultsLen := rand.Intn(20) + 1
-	results := make([]string, resultsLen)
-	for i := range results {
-		results[i] = uuid.New().String()
+	results, err := h.service.Search(c.Request().Context(), params)
+	if err != nil {
+		return fmt.Errorf("failed to search: %w", err)
 	}
+
 	return httpx.Render(c, searchviews.SearchResults(results))
 }
+
+func parseSearchParams(c echo.Context) (domain.SearchParams, error) {
+	workspace, _ := domain.WorkspaceFromContext(c.Request().Context())
+
+	params := domain.SearchParams{
+		WorkspaceID: workspace.ID,
+		Query:       c.QueryParam("query"),
+		Role:        c.QueryParam("role"),
+	}
+
+	if value := c.QueryParam("from"); value != "" {
+		from, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return params, fmt.Errorf("invalid start date: %s", value)
+		}
+		params.From = from
+	}
+
+	if value := c.QueryParam("to"); value != "" {
+		to, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return params, fmt.Errorf("invalid end date: %s", value)
+		}
+		params.To = to.AddDate(0, 0, 1)
+	}
+
+	return params, nil
+}
@@ -0,0 +1,147 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+var _ domain.SearchRepository = &PGXRepository{}
+
+// Markers that ts_headline wraps around matched words. They are control
+// characters so they can't clash with the message content, which is rendered
+// escaped.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+type PGXRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPGXRepository(pool *pgxpool.Pool) *PGXRepository {
+	return &PGXRepository{
+		pool: pool,
+	}
+}
+
+const searchQuery = `
+WITH query AS (
+	SELECT websearch_to_tsquery('english', $1) AS q
+)
+SELECT chat_id, chat_name, message_id, role, snippet, created_at
+FROM (
+	SELECT
+		c.id AS chat_id,
+		c.name AS chat_name,
+		NULL::uuid AS message_id,
+		NULL::varchar AS role,
+		ts_headline('english', c.name, query.q, $6) AS snippet,
+		ts_rank(to_tsvector('english', c.name), query.q) AS rank,
+		c.created_at
+	FROM chats c, query
+	WHERE to_tsvector('english', c.name) @@ query.q
+	AND c.workspace_id = $7
+	AND $2 = ''
+	AND ($3::timestamp IS NULL OR c.created_at >= $3)
+	AND ($4::timestamp IS NULL OR c.created_at < $4)
+	UNION ALL
+	SELECT
+		c.id AS chat_id,
+		c.name AS chat_name,
+		m.id AS message_id,
+		m.role,
+		ts_headline('english', m.content, query.q, $6) AS snippet,
+		ts_rank(to_tsvector('english', m.content), query.q) AS rank,
+		m.created_at
+	FROM chat_messages m
+	JOIN chats c ON c.id = m.chat_session_id, query
+	WHERE to_tsvector('english', m.content) @@ query.q
+	AND c.workspace_id = $7
+	AND ($2 = '' OR m.role = $2)
+	AND ($3::timestamp IS NULL OR m.created_at >= $3)
+	AND ($4::timestamp IS NULL OR m.created_at < $4)
+) results
+ORDER BY rank DESC, created_at DESC
+LIMIT $5;
+`
+
+func (p *PGXRepository) Search(ctx context.Context, params domain.SearchParams) ([]domain.SearchResult, error) {
+	params.ApplyDefaults()
+
+	rows, err := p.pool.Query(
+		ctx,
+		searchQuery,
+		params.Query,
+		params.Role,
+		optionalTime(params.From),
+		optionalTime(params.To),
+		params.Limit,
+		fmt.Sprintf("StartSel=%s, StopSel=%s, MaxFragments=2", highlightStart, highlightStop),
+		params.WorkspaceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+	defer rows.Close()
+
+	results := []domain.SearchResult{}
+	for rows.Next() {
+		var (
+			result  domain.SearchResult
+			snippet string
+		)
+		if err := rows.Scan(
+			&result.ChatSessionID,
+			&result.ChatName,
+			&result.MessageID,
+			&result.Role,
+			&snippet,
+			&result.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		result.Snippet = parseSnippet(snippet)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read search results: %w", err)
+	}
+
+	return results, nil
+}
+
+func parseSnippet(snippet string) []domain.SnippetPart {
+	parts := []domain.SnippetPart{}
+	for snippet != "" {
+		start := strings.Index(snippet, highlightStart)
+		if start == -1 {
+			parts = append(parts, domain.SnippetPart{Text: snippet})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, domain.SnippetPart{Text: snippet[:start]})
+		}
+		snippet = snippet[start+len(highlightStart):]
+
+		stop := strings.Index(snippet, highlightStop)
+		if stop == -1 {
+			stop = len(snippet)
+		}
+		parts = append(parts, domain.SnippetPart{Text: snippet[:stop], Highlighted: true})
+		snippet = strings.TrimPrefix(snippet[stop:], highlightStop)
+	}
+	return parts
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,26 @@
+package search
+
+import (
+	"context"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+var _ domain.SearchService = &Service{}
+
+type Service struct {
+	repository domain.SearchRepository
+}
+
+func NewService(repository domain.SearchRepository) *Service {
+	return &Service{
+		repository: repository,
+	}
+}
+
+func (s *Service) Search(ctx context.Context, params domain.SearchParams) ([]domain.SearchResult, error) {
+	if params.Query == "" {
+		return []domain.SearchResult{}, nil
+	}
+	return s.repository.Search(ctx, params)
+}
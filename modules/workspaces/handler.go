@@ -0,0 +1,205 @@
+package workspaces
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+	workspacesviews "github.com/raphael-foliveira/htmbot/modules/workspaces/views"
+	"github.com/raphael-foliveira/htmbot/platform/httpx"
+)
+
+const (
+	workspaceCookie = "workspace"
+	// workspaceHeader selects the workspace of API requests, which don't
+	// carry the cookie.
+	workspaceHeader = "X-Workspace-ID"
+)
+
+type HandlerConfig struct {
+	// InsecureCookies lets the workspace cookie be sent over plain HTTP, for
+	// local development.
+	InsecureCookies bool
+}
+
+type Handler struct {
+	service domain.WorkspaceService
+	config  HandlerConfig
+}
+
+func NewHandler(service domain.WorkspaceService, config HandlerConfig) *Handler {
+	return &Handler{
+		service: service,
+		config:  config,
+	}
+}
+
+func (h *Handler) Register(e *echo.Echo, middleware ...echo.MiddlewareFunc) {
+	read := httpx.RequireScope(domain.ScopeRead)
+	manage := httpx.RequireScope(domain.ScopeManage)
+
+	g := e.Group("/workspaces", middleware...)
+	g.GET("", h.workspacesPage, read)
+	g.POST("", h.createWorkspace, manage)
+	g.GET("/switcher", h.switcher, read, h.RequireWorkspace)
+
+	wg := g.Group("/:workspace-id")
+	wg.GET("", h.membersPage, read)
+	wg.POST("/switch", h.switchWorkspace, read)
+	wg.POST("/members", h.addMember, manage)
+	wg.PUT("/members/:user-id", h.updateMember, manage)
+	wg.DELETE("/members/:user-id", h.removeMember, manage)
+}
+
+// workspaceError maps domain errors to HTTP errors, anything else is left to
+// the default error handler.
+func workspaceError(err error, message string) error {
+	if errors.Is(err, domain.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "workspace not found")
+	}
+	if errors.Is(err, domain.ErrAccessDenied) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	return fmt.Errorf("%s: %w", message, err)
+}
+
+func (h *Handler) setWorkspaceCookie(c echo.Context, workspaceId string) {
+	c.SetCookie(&http.Cookie{
+		Name:     workspaceCookie,
+		Value:    workspaceId,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   !h.config.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *Handler) workspacesPage(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	memberships, err := h.service.ListWorkspaces(c.Request().Context(), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	return httpx.Render(c, workspacesviews.WorkspacesPage(memberships, nil))
+}
+
+func (h *Handler) createWorkspace(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, _ := domain.UserFromContext(ctx)
+
+	membership, err := h.service.CreateWorkspace(ctx, user.ID, c.FormValue("name"))
+	if err != nil {
+		memberships, listErr := h.service.ListWorkspaces(ctx, user.ID)
+		if listErr != nil {
+			return fmt.Errorf("failed to list workspaces: %w", listErr)
+		}
+		return httpx.Render(c, workspacesviews.WorkspaceList(memberships, err))
+	}
+
+	h.setWorkspaceCookie(c, membership.ID)
+	return httpx.HxRedirect(c, fmt.Sprintf("/workspaces/%s", membership.ID))
+}
+
+func (h *Handler) switcher(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, _ := domain.UserFromContext(ctx)
+	current, _ := domain.WorkspaceFromContext(ctx)
+
+	memberships, err := h.service.ListWorkspaces(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	return httpx.Render(c, workspacesviews.Switcher(current, memberships))
+}
+
+func (h *Handler) switchWorkspace(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	membership, err := h.service.GetMembership(c.Request().Context(), c.Param("workspace-id"), user.ID)
+	if err != nil {
+		return workspaceError(err, "failed to get workspace")
+	}
+
+	h.setWorkspaceCookie(c, membership.ID)
+	return httpx.HxRedirect(c, "/chat")
+}
+
+func (h *Handler) membersPage(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	membership, err := h.service.GetMembership(c.Request().Context(), c.Param("workspace-id"), user.ID)
+	if err != nil {
+		return workspaceError(err, "failed to get workspace")
+	}
+
+	members, err := h.service.ListMembers(c.Request().Context(), user.ID, membership.ID)
+	if err != nil {
+		return workspaceError(err, "failed to list members")
+	}
+
+	return httpx.Render(c, workspacesviews.MembersPage(membership, members))
+}
+
+func (h *Handler) addMember(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	_, err := h.service.AddMember(
+		c.Request().Context(),
+		user.ID,
+		c.Param("workspace-id"),
+		c.FormValue("email"),
+		c.FormValue("role"),
+	)
+
+	return h.renderMembers(c, err)
+}
+
+func (h *Handler) updateMember(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	err := h.service.UpdateMember(
+		c.Request().Context(),
+		user.ID,
+		c.Param("workspace-id"),
+		c.Param("user-id"),
+		c.FormValue("role"),
+	)
+
+	return h.renderMembers(c, err)
+}
+
+func (h *Handler) removeMember(c echo.Context) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+	memberId := c.Param("user-id")
+
+	err := h.service.RemoveMember(c.Request().Context(), user.ID, c.Param("workspace-id"), memberId)
+	if err == nil && memberId == user.ID {
+		return httpx.HxRedirect(c, "/chat")
+	}
+
+	return h.renderMembers(c, err)
+}
+
+// renderMembers renders the member list after a change, along with the error
+// that prevented it.
+func (h *Handler) renderMembers(c echo.Context, changeErr error) error {
+	user, _ := domain.UserFromContext(c.Request().Context())
+
+	membership, err := h.service.GetMembership(c.Request().Context(), c.Param("workspace-id"), user.ID)
+	if err != nil {
+		return workspaceError(err, "failed to get workspace")
+	}
+
+	members, err := h.service.ListMembers(c.Request().Context(), user.ID, membership.ID)
+	if err != nil {
+		return workspaceError(err, "failed to list members")
+	}
+
+	return httpx.Render(c, workspacesviews.Members(membership, members, changeErr))
+}
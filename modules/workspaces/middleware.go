@@ -0,0 +1,38 @@
+package workspaces
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// RequireWorkspace stores the workspace the request acts in in the request
+// context, where handlers get it with domain.WorkspaceFromContext. API
+// requests pick it with the X-Workspace-ID header and browsers with the cookie
+// set when switching, which falls back to the user's first workspace. It must
+// run after the user is authenticated.
+func (h *Handler) RequireWorkspace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		user, _ := domain.UserFromContext(ctx)
+
+		var (
+			membership domain.WorkspaceMembership
+			err        error
+		)
+		if workspaceId := c.Request().Header.Get(workspaceHeader); workspaceId != "" {
+			membership, err = h.service.GetMembership(ctx, workspaceId, user.ID)
+		} else {
+			workspaceId := ""
+			if cookie, cookieErr := c.Cookie(workspaceCookie); cookieErr == nil {
+				workspaceId = cookie.Value
+			}
+			membership, err = h.service.CurrentWorkspace(ctx, user.ID, workspaceId)
+		}
+		if err != nil {
+			return workspaceError(err, "failed to get workspace")
+		}
+
+		c.SetRequest(c.Request().WithContext(domain.WithWorkspace(ctx, membership)))
+		return next(c)
+	}
+}
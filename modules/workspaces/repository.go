@@ -0,0 +1,157 @@
+package workspaces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+var _ domain.WorkspaceRepository = &PGXRepository{}
+
+type PGXRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPGXRepository(pool *pgxpool.Pool) *PGXRepository {
+	return &PGXRepository{
+		pool: pool,
+	}
+}
+
+const createWorkspaceQuery = `
+WITH workspace AS (
+	INSERT INTO workspaces (name) VALUES ($2) RETURNING *
+), member AS (
+	INSERT INTO workspace_members (workspace_id, user_id, role)
+	SELECT id, $1, $3 FROM workspace
+)
+SELECT workspace.*, $3 AS role
+FROM workspace;
+`
+
+func (p *PGXRepository) CreateWorkspace(ctx context.Context, userId, name string) (domain.WorkspaceMembership, error) {
+	rows, err := p.pool.Query(ctx, createWorkspaceQuery, userId, name, domain.WorkspaceOwner)
+	if err != nil {
+		return domain.WorkspaceMembership{}, fmt.Errorf("failed to create workspace: %w", err)
+	}
+
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.WorkspaceMembership])
+}
+
+const listWorkspacesQuery = `
+SELECT w.*, m.role
+FROM workspaces w
+JOIN workspace_members m ON m.workspace_id = w.id
+WHERE m.user_id = $1
+ORDER BY m.created_at ASC;
+`
+
+func (p *PGXRepository) ListWorkspaces(ctx context.Context, userId string) ([]domain.WorkspaceMembership, error) {
+	rows, err := p.pool.Query(ctx, listWorkspacesQuery, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[domain.WorkspaceMembership])
+}
+
+const getMembershipQuery = `
+SELECT w.*, m.role
+FROM workspaces w
+JOIN workspace_members m ON m.workspace_id = w.id
+WHERE w.id = $1 AND m.user_id = $2;
+`
+
+func (p *PGXRepository) GetMembership(
+	ctx context.Context,
+	workspaceId, userId string,
+) (domain.WorkspaceMembership, error) {
+	rows, err := p.pool.Query(ctx, getMembershipQuery, workspaceId, userId)
+	if err != nil {
+		return domain.WorkspaceMembership{}, fmt.Errorf("failed to get membership: %w", err)
+	}
+
+	membership, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.WorkspaceMembership])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.WorkspaceMembership{}, fmt.Errorf("workspace %s: %w", workspaceId, domain.ErrNotFound)
+	}
+	return membership, err
+}
+
+const listMembersQuery = `
+SELECT m.user_id, u.email, m.role, m.created_at
+FROM workspace_members m
+JOIN users u ON u.id = m.user_id
+WHERE m.workspace_id = $1
+ORDER BY m.created_at ASC;
+`
+
+func (p *PGXRepository) ListMembers(ctx context.Context, workspaceId string) ([]domain.WorkspaceMember, error) {
+	rows, err := p.pool.Query(ctx, listMembersQuery, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[domain.WorkspaceMember])
+}
+
+const addMemberQuery = `
+WITH member AS (
+	INSERT INTO workspace_members (workspace_id, user_id, role)
+	SELECT $1, id, $3 FROM users WHERE email = $2
+	ON CONFLICT (workspace_id, user_id) DO NOTHING
+	RETURNING *
+)
+SELECT member.user_id, $2 AS email, member.role, member.created_at
+FROM member;
+`
+
+func (p *PGXRepository) AddMember(
+	ctx context.Context,
+	workspaceId, email, role string,
+) (domain.WorkspaceMember, error) {
+	rows, err := p.pool.Query(ctx, addMemberQuery, workspaceId, email, role)
+	if err != nil {
+		return domain.WorkspaceMember{}, fmt.Errorf("failed to add member: %w", err)
+	}
+
+	member, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[domain.WorkspaceMember])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.WorkspaceMember{}, fmt.Errorf("user %s: %w", email, domain.ErrNotFound)
+	}
+	return member, err
+}
+
+const updateMemberQuery = `
+UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2;
+`
+
+func (p *PGXRepository) UpdateMember(ctx context.Context, workspaceId, userId, role string) error {
+	tag, err := p.pool.Exec(ctx, updateMemberQuery, workspaceId, userId, role)
+	if err != nil {
+		return fmt.Errorf("failed to update member: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("member %s: %w", userId, domain.ErrNotFound)
+	}
+	return nil
+}
+
+const removeMemberQuery = `
+DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2;
+`
+
+func (p *PGXRepository) RemoveMember(ctx context.Context, workspaceId, userId string) error {
+	tag, err := p.pool.Exec(ctx, removeMemberQuery, workspaceId, userId)
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("member %s: %w", userId, domain.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package workspaces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// personalWorkspaceName names the workspace created for users who have none.
+const personalWorkspaceName = "Personal"
+
+var _ domain.WorkspaceService = &Service{}
+
+type Service struct {
+	repository domain.WorkspaceRepository
+}
+
+func NewService(repository domain.WorkspaceRepository) *Service {
+	return &Service{
+		repository: repository,
+	}
+}
+
+func (s *Service) ListWorkspaces(ctx context.Context, userId string) ([]domain.WorkspaceMembership, error) {
+	return s.repository.ListWorkspaces(ctx, userId)
+}
+
+func (s *Service) CreateWorkspace(ctx context.Context, userId, name string) (domain.WorkspaceMembership, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return domain.WorkspaceMembership{}, fmt.Errorf("name is required")
+	}
+
+	return s.repository.CreateWorkspace(ctx, userId, name)
+}
+
+func (s *Service) GetMembership(ctx context.Context, workspaceId, userId string) (domain.WorkspaceMembership, error) {
+	return s.repository.GetMembership(ctx, workspaceId, userId)
+}
+
+func (s *Service) CurrentWorkspace(ctx context.Context, userId, workspaceId string) (domain.WorkspaceMembership, error) {
+	if workspaceId != "" {
+		membership, err := s.repository.GetMembership(ctx, workspaceId, userId)
+		if err == nil {
+			return membership, nil
+		}
+		if !errors.Is(err, domain.ErrNotFound) {
+			return domain.WorkspaceMembership{}, err
+		}
+	}
+
+	memberships, err := s.repository.ListWorkspaces(ctx, userId)
+	if err != nil {
+		return domain.WorkspaceMembership{}, err
+	}
+	if len(memberships) > 0 {
+		return memberships[0], nil
+	}
+
+	return s.repository.CreateWorkspace(ctx, userId, personalWorkspaceName)
+}
+
+func (s *Service) ListMembers(ctx context.Context, userId, workspaceId string) ([]domain.WorkspaceMember, error) {
+	if _, err := s.authorize(ctx, userId, workspaceId, domain.WorkspaceViewer); err != nil {
+		return nil, err
+	}
+
+	return s.repository.ListMembers(ctx, workspaceId)
+}
+
+func (s *Service) AddMember(
+	ctx context.Context,
+	userId, workspaceId, email, role string,
+) (domain.WorkspaceMember, error) {
+	if _, err := s.authorize(ctx, userId, workspaceId, domain.WorkspaceOwner); err != nil {
+		return domain.WorkspaceMember{}, err
+	}
+
+	if err := validateRole(role); err != nil {
+		return domain.WorkspaceMember{}, err
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	member, err := s.repository.AddMember(ctx, workspaceId, email, role)
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.WorkspaceMember{}, fmt.Errorf("%s isn't registered or is already a member", email)
+	}
+	return member, err
+}
+
+func (s *Service) UpdateMember(ctx context.Context, userId, workspaceId, memberId, role string) error {
+	if _, err := s.authorize(ctx, userId, workspaceId, domain.WorkspaceOwner); err != nil {
+		return err
+	}
+
+	if err := validateRole(role); err != nil {
+		return err
+	}
+
+	if role != domain.WorkspaceOwner {
+		if err := s.keepOwner(ctx, workspaceId, memberId); err != nil {
+			return err
+		}
+	}
+
+	return s.repository.UpdateMember(ctx, workspaceId, memberId, role)
+}
+
+func (s *Service) RemoveMember(ctx context.Context, userId, workspaceId, memberId string) error {
+	required := domain.WorkspaceOwner
+	if memberId == userId {
+		required = domain.WorkspaceViewer
+	}
+	if _, err := s.authorize(ctx, userId, workspaceId, required); err != nil {
+		return err
+	}
+
+	if err := s.keepOwner(ctx, workspaceId, memberId); err != nil {
+		return err
+	}
+
+	return s.repository.RemoveMember(ctx, workspaceId, memberId)
+}
+
+func (s *Service) authorize(
+	ctx context.Context,
+	userId, workspaceId, role string,
+) (domain.WorkspaceMembership, error) {
+	membership, err := s.repository.GetMembership(ctx, workspaceId, userId)
+	if err != nil {
+		return domain.WorkspaceMembership{}, err
+	}
+
+	if !membership.Allows(role) {
+		return domain.WorkspaceMembership{}, domain.ErrAccessDenied
+	}
+
+	return membership, nil
+}
+
+// keepOwner returns ErrLastOwner when memberId is the only owner left, so the
+// workspace can't be orphaned by demoting or removing them.
+func (s *Service) keepOwner(ctx context.Context, workspaceId, memberId string) error {
+	members, err := s.repository.ListMembers(ctx, workspaceId)
+	if err != nil {
+		return err
+	}
+
+	owners := 0
+	isOwner := false
+	for _, member := range members {
+		if member.Role == domain.WorkspaceOwner {
+			owners++
+			isOwner = isOwner || member.UserID == memberId
+		}
+	}
+
+	if isOwner && owners == 1 {
+		return domain.ErrLastOwner
+	}
+
+	return nil
+}
+
+func validateRole(role string) error {
+	if !slices.Contains(domain.WorkspaceRoles, role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+	return nil
+}
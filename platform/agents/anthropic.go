@@ -0,0 +1,310 @@
+package agents
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/slicesx"
+)
+
+const (
+	anthropicDefaultModel  = anthropic.ModelClaudeSonnet4_5
+	anthropicMaxTokens     = 4096
+	anthropicMaxIterations = 15
+)
+
+// anthropicEffortModels lists the prefixes of the models that take an effort
+// level, other models reject it.
+var anthropicEffortModels = []string{"claude-opus-4-5", "claude-opus-4-6"}
+
+type Anthropic struct {
+	client anthropic.Client
+}
+
+// NewAnthropic creates an agent backed by the Anthropic Messages API. Extra
+// request options can be passed to point the client at a different base URL.
+func NewAnthropic(apiKey string, opts ...option.RequestOption) *Anthropic {
+	return &Anthropic{
+		client: anthropic.NewClient(append([]option.RequestOption{option.WithAPIKey(apiKey)}, opts...)...),
+	}
+}
+
+func (a *Anthropic) StreamResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+	callback func(delta string),
+) ([]domain.ChatMessage, error) {
+	return a.run(ctx, messages, tools, settings, func(params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		stream := a.client.Messages.NewStreaming(ctx, params)
+		defer stream.Close()
+
+		message := anthropic.Message{}
+		for stream.Next() {
+			event := stream.Current()
+			if err := message.Accumulate(event); err != nil {
+				return nil, fmt.Errorf("error accumulating stream event: %w", err)
+			}
+
+			if deltaEvent, ok := event.AsAny().(anthropic.ContentBlockDeltaEvent); ok {
+				if textDelta, ok := deltaEvent.Delta.AsAny().(anthropic.TextDelta); ok {
+					callback(textDelta.Text)
+				}
+			}
+		}
+		if err := stream.Err(); err != nil {
+			return nil, fmt.Errorf("error streaming response: %w", err)
+		}
+
+		return &message, nil
+	})
+}
+
+func (a *Anthropic) GenerateResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) ([]domain.ChatMessage, error) {
+	return a.run(ctx, messages, tools, settings, func(params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		message, err := a.client.Messages.New(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("error creating message: %w", err)
+		}
+		return message, nil
+	})
+}
+
+func (a *Anthropic) run(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+	send func(anthropic.MessageNewParams) (*anthropic.Message, error),
+) ([]domain.ChatMessage, error) {
+	system := a.chatMessagesToSystemBlocks(messages)
+	anthropicMessages := a.chatMessagesToAnthropicMessages(messages)
+	newMessages := []domain.ChatMessage{}
+
+	for range anthropicMaxIterations {
+		response, err := send(a.newParams(system, anthropicMessages, tools, settings))
+		if err != nil {
+			return nil, err
+		}
+
+		anthropicMessages = append(anthropicMessages, response.ToParam())
+
+		responseMessages, toolResults, err := a.handleResponse(ctx, tools, response)
+		if err != nil {
+			return nil, fmt.Errorf("error handling response: %w", err)
+		}
+		newMessages = append(newMessages, responseMessages...)
+
+		if len(toolResults) == 0 {
+			return newMessages, nil
+		}
+
+		anthropicMessages = append(anthropicMessages, anthropic.NewUserMessage(toolResults...))
+	}
+
+	return nil, fmt.Errorf("max number of iterations reached")
+}
+
+// ValidateSettings applies the Messages API limits: temperature only goes up to
+// 1, current models reject temperature and top_p in the same request and only
+// some models take an effort level.
+func (a *Anthropic) ValidateSettings(settings domain.GenerationSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	if settings.Temperature != nil && *settings.Temperature > 1 {
+		return fmt.Errorf("temperature must be between 0 and 1")
+	}
+
+	if settings.Temperature != nil && settings.TopP != nil {
+		return fmt.Errorf("temperature and top_p can't be set together")
+	}
+
+	model := cmp.Or(settings.Model, string(anthropicDefaultModel))
+	if settings.ReasoningEffort != "" && !slices.ContainsFunc(anthropicEffortModels, func(prefix string) bool {
+		return strings.HasPrefix(model, prefix)
+	}) {
+		return fmt.Errorf("reasoning effort isn't supported by %s", model)
+	}
+
+	return nil
+}
+
+func (a *Anthropic) newParams(
+	system []anthropic.TextBlockParam,
+	anthropicMessages []anthropic.MessageParam,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) anthropic.MessageNewParams {
+	params := anthropic.MessageNewParams{
+		Model:     anthropicDefaultModel,
+		MaxTokens: anthropicMaxTokens,
+		System:    system,
+		Messages:  anthropicMessages,
+		Tools:     slicesx.Map(tools, a.toolToAnthropicTool),
+	}
+
+	if settings.Model != "" {
+		params.Model = anthropic.Model(settings.Model)
+	}
+	if settings.Temperature != nil {
+		params.Temperature = anthropic.Float(*settings.Temperature)
+	}
+	if settings.TopP != nil {
+		params.TopP = anthropic.Float(*settings.TopP)
+	}
+	if settings.MaxOutputTokens != nil {
+		params.MaxTokens = *settings.MaxOutputTokens
+	}
+	if settings.ReasoningEffort != "" {
+		params.OutputConfig = anthropic.OutputConfigParam{
+			Effort: anthropic.OutputConfigEffort(settings.ReasoningEffort),
+		}
+	}
+
+	return params
+}
+
+func (a *Anthropic) handleResponse(
+	ctx context.Context,
+	tools []domain.LLMTool,
+	response *anthropic.Message,
+) ([]domain.ChatMessage, []anthropic.ContentBlockParamUnion, error) {
+	if response.StopReason == anthropic.StopReasonRefusal {
+		return nil, nil, fmt.Errorf("message refused by the model")
+	}
+
+	chatMessages := []domain.ChatMessage{}
+	toolResultMessages := []domain.ChatMessage{}
+	toolResults := []anthropic.ContentBlockParamUnion{}
+
+	for _, block := range response.Content {
+		switch block.Type {
+		case "text":
+			if block.Text == "" {
+				continue
+			}
+			chatMessages = append(chatMessages, domain.ChatMessage{
+				Role:    "assistant",
+				Content: block.Text,
+			})
+
+		case "tool_use":
+			name, callId, args := block.Name, block.ID, string(block.Input)
+			chatMessages = append(chatMessages, domain.ChatMessage{
+				Role:   "tool_call",
+				Name:   &name,
+				Args:   &args,
+				CallID: &callId,
+			})
+
+			result, err := executeToolCall(ctx, tools, name, args)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error processing tool calls: %w", err)
+			}
+			toolResultMessages = append(toolResultMessages, domain.ChatMessage{
+				Role:   "tool_result",
+				Name:   &name,
+				CallID: &callId,
+				Result: &result,
+			})
+			toolResults = append(toolResults, anthropic.NewToolResultBlock(callId, result, false))
+		}
+	}
+
+	return append(chatMessages, toolResultMessages...), toolResults, nil
+}
+
+// chatMessagesToSystemBlocks collects the system messages, which the Messages
+// API takes as a top-level parameter instead of as part of the conversation.
+func (a *Anthropic) chatMessagesToSystemBlocks(messages []domain.ChatMessage) []anthropic.TextBlockParam {
+	system := []anthropic.TextBlockParam{}
+	for _, message := range messages {
+		if message.Role == "system" && message.Content != "" {
+			system = append(system, anthropic.TextBlockParam{Text: message.Content})
+		}
+	}
+	return system
+}
+
+// chatMessagesToAnthropicMessages groups consecutive messages of the same role
+// into a single turn, since the Messages API expects user and assistant turns
+// to alternate.
+func (a *Anthropic) chatMessagesToAnthropicMessages(messages []domain.ChatMessage) []anthropic.MessageParam {
+	anthropicMessages := []anthropic.MessageParam{}
+	for _, message := range dropOrphanToolMessages(messages) {
+		var (
+			role  anthropic.MessageParamRole
+			block anthropic.ContentBlockParamUnion
+		)
+
+		switch {
+		case message.Role == "user" || message.Role == "assistant":
+			if message.Content == "" {
+				continue
+			}
+			role = anthropic.MessageParamRole(message.Role)
+			block = anthropic.NewTextBlock(message.Content)
+
+		case message.Args != nil:
+			role = anthropic.MessageParamRoleAssistant
+			block = anthropic.NewToolUseBlock(*message.CallID, json.RawMessage(*message.Args), *message.Name)
+
+		case message.Result != nil:
+			role = anthropic.MessageParamRoleUser
+			block = anthropic.NewToolResultBlock(*message.CallID, *message.Result, false)
+
+		default:
+			continue
+		}
+
+		if len(anthropicMessages) == 0 && role != anthropic.MessageParamRoleUser {
+			continue
+		}
+
+		last := len(anthropicMessages) - 1
+		if last >= 0 && anthropicMessages[last].Role == role {
+			anthropicMessages[last].Content = append(anthropicMessages[last].Content, block)
+			continue
+		}
+
+		anthropicMessages = append(anthropicMessages, anthropic.MessageParam{
+			Role:    role,
+			Content: []anthropic.ContentBlockParamUnion{block},
+		})
+	}
+
+	return anthropicMessages
+}
+
+func (a *Anthropic) toolToAnthropicTool(tool domain.LLMTool) anthropic.ToolUnionParam {
+	parameters := tool.Parameters()
+	inputSchema := anthropic.ToolInputSchemaParam{
+		Properties: parameters["properties"],
+	}
+	if required, ok := parameters["required"].([]string); ok {
+		inputSchema.Required = required
+	}
+
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        tool.Name(),
+			Description: anthropic.String(tool.Description()),
+			InputSchema: inputSchema,
+		},
+	}
+}
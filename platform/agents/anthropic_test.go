@@ -0,0 +1,308 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// anthropicStub stands in for the Messages API. It answers each request with
+// the next of its responses and records the request bodies.
+type anthropicStub struct {
+	t         *testing.T
+	responses []func(w http.ResponseWriter)
+
+	mu       sync.Mutex
+	requests []map[string]any
+}
+
+func (s *anthropicStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/messages" {
+		s.t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Errorf("failed to read request body: %v", err)
+	}
+	request := map[string]any{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		s.t.Errorf("failed to decode request body: %v", err)
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	i := len(s.requests) - 1
+	s.mu.Unlock()
+
+	if i >= len(s.responses) {
+		s.t.Errorf("unexpected request number %d", i+1)
+		http.Error(w, "no more responses", http.StatusInternalServerError)
+		return
+	}
+	s.responses[i](w)
+}
+
+func newAnthropicStub(t *testing.T, responses ...func(w http.ResponseWriter)) (*Anthropic, *anthropicStub) {
+	stub := &anthropicStub{t: t, responses: responses}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	return NewAnthropic("test-key", option.WithBaseURL(server.URL), option.WithMaxRetries(0)), stub
+}
+
+func sseEvents(events ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			var typed struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal([]byte(event), &typed)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, event)
+		}
+	}
+}
+
+func jsonMessage(content string, stopReason string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"id": "msg_1",
+			"type": "message",
+			"role": "assistant",
+			"model": "claude-test",
+			"content": %s,
+			"stop_reason": %q,
+			"stop_sequence": null,
+			"usage": {"input_tokens": 1, "output_tokens": 1}
+		}`, content, stopReason)
+	}
+}
+
+const messageStart = `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant",` +
+	`"model":"claude-test","content":[],"stop_reason":null,"stop_sequence":null,` +
+	`"usage":{"input_tokens":1,"output_tokens":1}}}`
+
+func messageDelta(stopReason string) string {
+	return fmt.Sprintf(`{"type":"message_delta","delta":{"stop_reason":%q,"stop_sequence":null},`+
+		`"usage":{"output_tokens":1}}`, stopReason)
+}
+
+func newEchoTool() domain.LLMTool {
+	return NewLLMTool(
+		"echo",
+		"Echoes the name",
+		map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"name": map[string]any{"type": "string"},
+			},
+			"required": []string{"name"},
+		},
+		func(ctx context.Context, args struct {
+			Name string `json:"name"`
+		}) (string, error) {
+			return "hello " + args.Name, nil
+		},
+	)
+}
+
+// contentBlocks returns the content blocks of a message of a recorded request.
+func contentBlocks(t *testing.T, request map[string]any, message int) []map[string]any {
+	t.Helper()
+
+	messages, _ := request["messages"].([]any)
+	if message >= len(messages) {
+		t.Fatalf("request has %d messages, want more than %d", len(messages), message)
+	}
+
+	blocks := []map[string]any{}
+	content, _ := messages[message].(map[string]any)["content"].([]any)
+	for _, block := range content {
+		blocks = append(blocks, block.(map[string]any))
+	}
+	return blocks
+}
+
+func TestAnthropicStreamResponse(t *testing.T) {
+	agent, stub := newAnthropicStub(t,
+		sseEvents(
+			messageStart,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"echo","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"name\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Ada\"}"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			messageDelta("tool_use"),
+			`{"type":"message_stop"}`,
+		),
+		sseEvents(
+			messageStart,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Done."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			messageDelta("end_turn"),
+			`{"type":"message_stop"}`,
+		),
+	)
+
+	deltas := []string{}
+	messages, err := agent.StreamResponse(
+		context.Background(),
+		[]domain.ChatMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Greet Ada"},
+		},
+		[]domain.LLMTool{newEchoTool()},
+		domain.GenerationSettings{},
+		func(delta string) { deltas = append(deltas, delta) },
+	)
+	if err != nil {
+		t.Fatalf("StreamResponse failed: %v", err)
+	}
+
+	if got := strings.Join(deltas, "|"); got != "Let me |check.|Done." {
+		t.Errorf("deltas = %q", got)
+	}
+
+	if len(messages) != 4 {
+		t.Fatalf("got %d messages, want 4: %+v", len(messages), messages)
+	}
+	if messages[0].Role != "assistant" || messages[0].Content != "Let me check." {
+		t.Errorf("first message = %+v", messages[0])
+	}
+	call := messages[1]
+	if call.Role != "tool_call" || *call.Name != "echo" || *call.CallID != "toolu_1" || *call.Args != `{"name":"Ada"}` {
+		t.Errorf("tool call = %+v", call)
+	}
+	result := messages[2]
+	if result.Role != "tool_result" || *result.Name != "echo" || *result.CallID != "toolu_1" ||
+		*result.Result != `"hello Ada"` {
+		t.Errorf("tool result = %+v", result)
+	}
+	if messages[3].Role != "assistant" || messages[3].Content != "Done." {
+		t.Errorf("last message = %+v", messages[3])
+	}
+
+	if len(stub.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(stub.requests))
+	}
+	first := stub.requests[0]
+	if first["stream"] != true {
+		t.Errorf("first request isn't streamed")
+	}
+	if system, _ := first["system"].([]any); len(system) != 1 || system[0].(map[string]any)["text"] != "Be brief." {
+		t.Errorf("system = %v", first["system"])
+	}
+
+	// The follow-up sends the tool use back along with its result.
+	second := stub.requests[1]
+	toolUse := contentBlocks(t, second, 1)[1]
+	if toolUse["type"] != "tool_use" || toolUse["id"] != "toolu_1" || toolUse["name"] != "echo" {
+		t.Errorf("tool_use block = %v", toolUse)
+	}
+	toolResult := contentBlocks(t, second, 2)[0]
+	if toolResult["type"] != "tool_result" || toolResult["tool_use_id"] != "toolu_1" {
+		t.Errorf("tool_result block = %v", toolResult)
+	}
+	if !strings.Contains(fmt.Sprint(toolResult["content"]), `"hello Ada"`) {
+		t.Errorf("tool_result content = %v", toolResult["content"])
+	}
+}
+
+func TestAnthropicGenerateResponseSendsToolHistory(t *testing.T) {
+	agent, stub := newAnthropicStub(t, jsonMessage(`[{"type":"text","text":"It said hello."}]`, "end_turn"))
+
+	name, callId, args, result := "echo", "toolu_9", `{"name":"Bob"}`, `"hello Bob"`
+	messages, err := agent.GenerateResponse(
+		context.Background(),
+		[]domain.ChatMessage{
+			{Role: "user", Content: "Greet Bob"},
+			{Role: "tool_call", Name: &name, CallID: &callId, Args: &args},
+			{Role: "tool_result", Name: &name, CallID: &callId, Result: &result},
+			{Role: "user", Content: "What did it say?"},
+		},
+		[]domain.LLMTool{newEchoTool()},
+		domain.GenerationSettings{},
+	)
+	if err != nil {
+		t.Fatalf("GenerateResponse failed: %v", err)
+	}
+
+	if len(messages) != 1 || messages[0].Content != "It said hello." {
+		t.Errorf("messages = %+v", messages)
+	}
+
+	request := stub.requests[0]
+	if request["stream"] == true {
+		t.Errorf("request is streamed")
+	}
+
+	toolUse := contentBlocks(t, request, 1)[0]
+	if toolUse["type"] != "tool_use" || toolUse["id"] != callId || toolUse["name"] != name {
+		t.Errorf("tool_use block = %v", toolUse)
+	}
+	if input, _ := json.Marshal(toolUse["input"]); string(input) != args {
+		t.Errorf("tool_use input = %s", input)
+	}
+
+	// The tool result and the next user message share the user turn.
+	userTurn := contentBlocks(t, request, 2)
+	if len(userTurn) != 2 || userTurn[0]["type"] != "tool_result" || userTurn[0]["tool_use_id"] != callId {
+		t.Errorf("user turn = %v", userTurn)
+	}
+	if !strings.Contains(fmt.Sprint(userTurn[0]["content"]), result) {
+		t.Errorf("tool_result content = %v", userTurn[0]["content"])
+	}
+}
+
+func TestAnthropicValidateSettings(t *testing.T) {
+	float := func(value float64) *float64 { return &value }
+
+	tests := []struct {
+		name     string
+		settings domain.GenerationSettings
+		wantErr  bool
+	}{
+		{name: "defaults", settings: domain.GenerationSettings{}},
+		{name: "temperature", settings: domain.GenerationSettings{Temperature: float(1)}},
+		{name: "temperature above 1", settings: domain.GenerationSettings{Temperature: float(1.5)}, wantErr: true},
+		{name: "top_p", settings: domain.GenerationSettings{TopP: float(0.9)}},
+		{
+			name:     "temperature and top_p",
+			settings: domain.GenerationSettings{Temperature: float(0.5), TopP: float(0.9)},
+			wantErr:  true,
+		},
+		{
+			name:     "effort on a model that takes it",
+			settings: domain.GenerationSettings{Model: "claude-opus-4-5-20251101", ReasoningEffort: "low"},
+		},
+		{name: "effort on the default model", settings: domain.GenerationSettings{ReasoningEffort: "low"}, wantErr: true},
+		{name: "generic checks", settings: domain.GenerationSettings{TopP: float(2)}, wantErr: true},
+	}
+
+	agent := NewAnthropic("test-key")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := agent.ValidateSettings(test.settings)
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateSettings() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
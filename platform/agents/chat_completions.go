@@ -0,0 +1,303 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/packages/param"
+	"github.com/openai/openai-go/v3/shared"
+	"github.com/raphael-foliveira/htmbot/domain"
+	"github.com/raphael-foliveira/htmbot/platform/slicesx"
+)
+
+const chatCompletionsMaxIterations = 15
+
+// ChatCompletions is an agent for servers that only expose the
+// /v1/chat/completions endpoint, such as vLLM or llama.cpp.
+type ChatCompletions struct {
+	client openai.Client
+	model  string
+}
+
+func NewChatCompletions(baseURL, apiKey, model string) *ChatCompletions {
+	return &ChatCompletions{
+		client: openai.NewClient(
+			option.WithBaseURL(baseURL),
+			option.WithAPIKey(apiKey),
+		),
+		model: model,
+	}
+}
+
+type chatCompletionToolCall struct {
+	index int64
+	id    string
+	name  string
+	args  strings.Builder
+}
+
+type chatCompletionTurn struct {
+	content   strings.Builder
+	refusal   string
+	toolCalls []*chatCompletionToolCall
+}
+
+func (t *chatCompletionTurn) addToolCallDelta(delta openai.ChatCompletionChunkChoiceDeltaToolCall) {
+	index := slices.IndexFunc(t.toolCalls, func(toolCall *chatCompletionToolCall) bool {
+		return toolCall.index == delta.Index
+	})
+	if index == -1 {
+		t.toolCalls = append(t.toolCalls, &chatCompletionToolCall{index: delta.Index})
+		index = len(t.toolCalls) - 1
+	}
+
+	toolCall := t.toolCalls[index]
+	if delta.ID != "" {
+		toolCall.id = delta.ID
+	}
+	if delta.Function.Name != "" {
+		toolCall.name = delta.Function.Name
+	}
+	toolCall.args.WriteString(delta.Function.Arguments)
+}
+
+func (c *ChatCompletions) StreamResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+	callback func(delta string),
+) ([]domain.ChatMessage, error) {
+	return c.run(ctx, messages, tools, settings, func(params openai.ChatCompletionNewParams) (*chatCompletionTurn, error) {
+		stream := c.client.Chat.Completions.NewStreaming(ctx, params)
+		defer stream.Close()
+
+		turn := &chatCompletionTurn{}
+		for stream.Next() {
+			chunk := stream.Current()
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+
+			delta := chunk.Choices[0].Delta
+			if delta.Content != "" {
+				turn.content.WriteString(delta.Content)
+				callback(delta.Content)
+			}
+			turn.refusal += delta.Refusal
+			for _, toolCall := range delta.ToolCalls {
+				turn.addToolCallDelta(toolCall)
+			}
+		}
+		if err := stream.Err(); err != nil {
+			return nil, fmt.Errorf("error streaming chat completion: %w", err)
+		}
+
+		return turn, nil
+	})
+}
+
+func (c *ChatCompletions) GenerateResponse(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) ([]domain.ChatMessage, error) {
+	return c.run(ctx, messages, tools, settings, func(params openai.ChatCompletionNewParams) (*chatCompletionTurn, error) {
+		completion, err := c.client.Chat.Completions.New(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("error creating chat completion: %w", err)
+		}
+		if len(completion.Choices) == 0 {
+			return nil, fmt.Errorf("chat completion has no choices")
+		}
+
+		message := completion.Choices[0].Message
+		turn := &chatCompletionTurn{refusal: message.Refusal}
+		turn.content.WriteString(message.Content)
+		for i, toolCall := range message.ToolCalls {
+			turn.addToolCallDelta(openai.ChatCompletionChunkChoiceDeltaToolCall{
+				Index: int64(i),
+				ID:    toolCall.ID,
+				Function: openai.ChatCompletionChunkChoiceDeltaToolCallFunction{
+					Name:      toolCall.Function.Name,
+					Arguments: toolCall.Function.Arguments,
+				},
+			})
+		}
+
+		return turn, nil
+	})
+}
+
+func (c *ChatCompletions) run(
+	ctx context.Context,
+	messages []domain.ChatMessage,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+	send func(openai.ChatCompletionNewParams) (*chatCompletionTurn, error),
+) ([]domain.ChatMessage, error) {
+	completionMessages := c.chatMessagesToCompletionMessages(messages)
+	newMessages := []domain.ChatMessage{}
+
+	for range chatCompletionsMaxIterations {
+		turn, err := send(c.newParams(completionMessages, tools, settings))
+		if err != nil {
+			return nil, err
+		}
+		if turn.refusal != "" {
+			return nil, fmt.Errorf("message refused by the model: %s", turn.refusal)
+		}
+
+		turnMessages, err := c.handleTurn(ctx, tools, turn)
+		if err != nil {
+			return nil, fmt.Errorf("error handling response: %w", err)
+		}
+		newMessages = append(newMessages, turnMessages...)
+		completionMessages = append(completionMessages, c.chatMessagesToCompletionMessages(turnMessages)...)
+
+		if len(turn.toolCalls) == 0 {
+			return newMessages, nil
+		}
+	}
+
+	return nil, fmt.Errorf("max number of iterations reached")
+}
+
+func (c *ChatCompletions) ValidateSettings(settings domain.GenerationSettings) error {
+	return settings.Validate()
+}
+
+func (c *ChatCompletions) newParams(
+	completionMessages []openai.ChatCompletionMessageParamUnion,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) openai.ChatCompletionNewParams {
+	params := openai.ChatCompletionNewParams{
+		Model:    c.model,
+		Messages: completionMessages,
+	}
+
+	if len(tools) > 0 {
+		params.Tools = slicesx.Map(tools, c.toolToCompletionTool)
+	}
+	if settings.Model != "" {
+		params.Model = settings.Model
+	}
+	if settings.Temperature != nil {
+		params.Temperature = openai.Float(*settings.Temperature)
+	}
+	if settings.TopP != nil {
+		params.TopP = openai.Float(*settings.TopP)
+	}
+	if settings.MaxOutputTokens != nil {
+		params.MaxTokens = openai.Int(*settings.MaxOutputTokens)
+	}
+	if settings.ReasoningEffort != "" {
+		params.ReasoningEffort = shared.ReasoningEffort(settings.ReasoningEffort)
+	}
+
+	return params
+}
+
+func (c *ChatCompletions) handleTurn(
+	ctx context.Context,
+	tools []domain.LLMTool,
+	turn *chatCompletionTurn,
+) ([]domain.ChatMessage, error) {
+	chatMessages := []domain.ChatMessage{}
+	if turn.content.Len() > 0 {
+		chatMessages = append(chatMessages, domain.ChatMessage{
+			Role:    "assistant",
+			Content: turn.content.String(),
+		})
+	}
+
+	toolResultMessages := []domain.ChatMessage{}
+	for _, toolCall := range turn.toolCalls {
+		name, callId, args := toolCall.name, toolCall.id, toolCall.args.String()
+		if args == "" {
+			args = "{}"
+		}
+		chatMessages = append(chatMessages, domain.ChatMessage{
+			Role:   "tool_call",
+			Name:   &name,
+			Args:   &args,
+			CallID: &callId,
+		})
+
+		result, err := executeToolCall(ctx, tools, name, args)
+		if err != nil {
+			return nil, fmt.Errorf("error processing tool calls: %w", err)
+		}
+		toolResultMessages = append(toolResultMessages, domain.ChatMessage{
+			Role:   "tool_result",
+			Name:   &name,
+			CallID: &callId,
+			Result: &result,
+		})
+	}
+
+	return append(chatMessages, toolResultMessages...), nil
+}
+
+// chatMessagesToCompletionMessages attaches tool calls to the assistant
+// message that precedes them, since Chat Completions carries tool calls on the
+// assistant message rather than as standalone items.
+func (c *ChatCompletions) chatMessagesToCompletionMessages(messages []domain.ChatMessage) []openai.ChatCompletionMessageParamUnion {
+	completionMessages := []openai.ChatCompletionMessageParamUnion{}
+	for _, message := range dropOrphanToolMessages(messages) {
+		switch {
+		case message.Role == "system":
+			completionMessages = append(completionMessages, openai.SystemMessage(message.Content))
+
+		case message.Role == "user":
+			completionMessages = append(completionMessages, openai.UserMessage(message.Content))
+
+		case message.Role == "assistant":
+			completionMessages = append(completionMessages, openai.AssistantMessage(message.Content))
+
+		case message.Args != nil:
+			toolCall := openai.ChatCompletionMessageToolCallUnionParam{
+				OfFunction: &openai.ChatCompletionMessageFunctionToolCallParam{
+					ID: *message.CallID,
+					Function: openai.ChatCompletionMessageFunctionToolCallFunctionParam{
+						Name:      *message.Name,
+						Arguments: *message.Args,
+					},
+				},
+			}
+
+			last := len(completionMessages) - 1
+			if last >= 0 && completionMessages[last].OfAssistant != nil {
+				completionMessages[last].OfAssistant.ToolCalls = append(completionMessages[last].OfAssistant.ToolCalls, toolCall)
+				continue
+			}
+
+			completionMessages = append(completionMessages, openai.ChatCompletionMessageParamUnion{
+				OfAssistant: &openai.ChatCompletionAssistantMessageParam{
+					ToolCalls: []openai.ChatCompletionMessageToolCallUnionParam{toolCall},
+				},
+			})
+
+		case message.Result != nil:
+			completionMessages = append(completionMessages, openai.ToolMessage(*message.Result, *message.CallID))
+		}
+	}
+
+	return completionMessages
+}
+
+func (c *ChatCompletions) toolToCompletionTool(tool domain.LLMTool) openai.ChatCompletionToolUnionParam {
+	return openai.ChatCompletionFunctionTool(shared.FunctionDefinitionParam{
+		Name: tool.Name(),
+		Description: param.Opt[string]{
+			Value: tool.Description(),
+		},
+		Parameters: tool.Parameters(),
+	})
+}
@@ -2,7 +2,6 @@ package agents
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
@@ -11,17 +10,22 @@ import (
 	"github.com/openai/openai-go/v3/option"
 	"github.com/openai/openai-go/v3/packages/param"
 	"github.com/openai/openai-go/v3/responses"
+	"github.com/openai/openai-go/v3/shared"
 	"github.com/raphael-foliveira/htmbot/domain"
 	"github.com/raphael-foliveira/htmbot/platform/slicesx"
 )
 
+const openAIDefaultModel = "gpt-4o-mini"
+
 type OpenAI struct {
 	client openai.Client
 }
 
-func NewOpenAI(apiKey string) *OpenAI {
+// NewOpenAI creates an agent backed by the OpenAI Responses API. Extra request
+// options can be passed to point the client at a different base URL.
+func NewOpenAI(apiKey string, opts ...option.RequestOption) *OpenAI {
 	return &OpenAI{
-		client: openai.NewClient(option.WithAPIKey(apiKey)),
+		client: openai.NewClient(append([]option.RequestOption{option.WithAPIKey(apiKey)}, opts...)...),
 	}
 }
 
@@ -29,93 +33,73 @@ func (o *OpenAI) StreamResponse(
 	ctx context.Context,
 	messages []domain.ChatMessage,
 	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
 	callback func(delta string),
 ) ([]domain.ChatMessage, error) {
-	var (
-		err              error
-		hasFunctionCalls bool
-	)
-
-	openaiMessages := slicesx.Map(messages, o.chatMessageToOpenAIMessage)
-	openaiMessages = o.removeOrphanToolReturns(openaiMessages)
+	openaiMessages := slicesx.Map(dropOrphanToolMessages(messages), o.chatMessageToOpenAIMessage)
 	initialMessagesLength := len(openaiMessages)
 
-	for {
-		hasFunctionCalls = false
-		stream := o.client.Responses.NewStreaming(ctx, responses.ResponseNewParams{
-			Input: responses.ResponseNewParamsInputUnion{
-				OfInputItemList: openaiMessages,
-			},
-			Model: "gpt-4o-mini",
-			Tools: slicesx.Map(tools, func(tool domain.LLMTool) responses.ToolUnionParam {
-				return responses.ToolUnionParam{
-					OfFunction: &responses.FunctionToolParam{
-						Name: tool.Name(),
-						Description: param.Opt[string]{
-							Value: tool.Description(),
-						},
-						Parameters: tool.Parameters(),
-					},
-				}
-			}),
-		})
-		for stream.Next() {
-			currentEvent := stream.Current()
-			eventType := currentEvent.Type
-			switch eventType {
-			case "response.output_text.delta":
-				delta := currentEvent.AsResponseOutputTextDelta()
-				callback(delta.Delta)
-			case "response.completed":
-				completedEvent := currentEvent.AsResponseCompleted()
-				response := &completedEvent.Response
-				openaiMessages = append(openaiMessages, o.responsesResponseToInputItems(response)...)
-				openaiMessages, hasFunctionCalls, err = o.handleResponse(ctx, tools, response, openaiMessages)
-				if err != nil {
-					return nil, fmt.Errorf("error handling response: %w", err)
-				}
-				if !hasFunctionCalls {
-					return slicesx.Map(openaiMessages[initialMessagesLength:], o.openAIMessageToChatMessage), nil
-				}
-			}
+	for range 15 {
+		hasFunctionCalls := false
+		response, err := o.streamResponse(ctx, o.newParams(openaiMessages, tools, settings), callback)
+		if err != nil {
+			return nil, err
+		}
+		openaiMessages = append(openaiMessages, o.responsesResponseToInputItems(response)...)
+
+		openaiMessages, hasFunctionCalls, err = o.handleResponse(ctx, tools, response, openaiMessages)
+		if err != nil {
+			return nil, fmt.Errorf("error handling response: %w", err)
+		}
+
+		if !hasFunctionCalls {
+			return slicesx.Map(openaiMessages[initialMessagesLength:], o.openAIMessageToChatMessage), nil
 		}
 	}
+
+	return nil, fmt.Errorf("max number of iterations reached")
 }
 
-func (o *OpenAI) removeOrphanToolReturns(messages []responses.ResponseInputItemUnionParam) []responses.ResponseInputItemUnionParam {
-	for messages[0].OfFunctionCallOutput != nil {
-		messages = messages[1:]
+// streamResponse streams a single response, passing its text to callback, and
+// returns it once it's completed. A stream that ends before that, e.g. because
+// ctx was cancelled or the response failed, is an error.
+func (o *OpenAI) streamResponse(
+	ctx context.Context,
+	params responses.ResponseNewParams,
+	callback func(delta string),
+) (*responses.Response, error) {
+	stream := o.client.Responses.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	for stream.Next() {
+		currentEvent := stream.Current()
+		switch currentEvent.Type {
+		case "response.output_text.delta":
+			callback(currentEvent.AsResponseOutputTextDelta().Delta)
+		case "response.completed":
+			completedEvent := currentEvent.AsResponseCompleted()
+			return &completedEvent.Response, nil
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, fmt.Errorf("error streaming response: %w", err)
 	}
-	return messages
+
+	return nil, fmt.Errorf("stream ended before the response was completed")
 }
 
 func (o *OpenAI) GenerateResponse(
 	ctx context.Context,
 	messages []domain.ChatMessage,
 	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
 ) ([]domain.ChatMessage, error) {
-	initialMessagesLength := len(messages)
-	openaiMessages := slicesx.Map(messages, o.chatMessageToOpenAIMessage)
+	openaiMessages := slicesx.Map(dropOrphanToolMessages(messages), o.chatMessageToOpenAIMessage)
+	initialMessagesLength := len(openaiMessages)
 
 	for range 15 {
 		hasFunctionCalls := false
-		response, err := o.client.Responses.New(ctx, responses.ResponseNewParams{
-			Input: responses.ResponseNewParamsInputUnion{
-				OfInputItemList: openaiMessages,
-			},
-			Model: "gpt-4o-mini",
-			Tools: slicesx.Map(tools, func(tool domain.LLMTool) responses.ToolUnionParam {
-				return responses.ToolUnionParam{
-					OfFunction: &responses.FunctionToolParam{
-						Name: tool.Name(),
-						Description: param.Opt[string]{
-							Value: tool.Description(),
-						},
-						Parameters: tool.Parameters(),
-					},
-				}
-			}),
-		})
+		response, err := o.client.Responses.New(ctx, o.newParams(openaiMessages, tools, settings))
 		if err != nil {
 			log.Println("error creating response:", err)
 			return nil, fmt.Errorf("error creating response: %w", err)
@@ -135,6 +119,54 @@ func (o *OpenAI) GenerateResponse(
 	return nil, fmt.Errorf("max number of iterations reached")
 }
 
+func (o *OpenAI) ValidateSettings(settings domain.GenerationSettings) error {
+	return settings.Validate()
+}
+
+func (o *OpenAI) newParams(
+	openaiMessages []responses.ResponseInputItemUnionParam,
+	tools []domain.LLMTool,
+	settings domain.GenerationSettings,
+) responses.ResponseNewParams {
+	params := responses.ResponseNewParams{
+		Input: responses.ResponseNewParamsInputUnion{
+			OfInputItemList: openaiMessages,
+		},
+		Model: openAIDefaultModel,
+		Tools: slicesx.Map(tools, func(tool domain.LLMTool) responses.ToolUnionParam {
+			return responses.ToolUnionParam{
+				OfFunction: &responses.FunctionToolParam{
+					Name: tool.Name(),
+					Description: param.Opt[string]{
+						Value: tool.Description(),
+					},
+					Parameters: tool.Parameters(),
+				},
+			}
+		}),
+	}
+
+	if settings.Model != "" {
+		params.Model = settings.Model
+	}
+	if settings.Temperature != nil {
+		params.Temperature = openai.Float(*settings.Temperature)
+	}
+	if settings.TopP != nil {
+		params.TopP = openai.Float(*settings.TopP)
+	}
+	if settings.MaxOutputTokens != nil {
+		params.MaxOutputTokens = openai.Int(*settings.MaxOutputTokens)
+	}
+	if settings.ReasoningEffort != "" {
+		params.Reasoning = shared.ReasoningParam{
+			Effort: shared.ReasoningEffort(settings.ReasoningEffort),
+		}
+	}
+
+	return params
+}
+
 func (o *OpenAI) handleResponse(ctx context.Context, tools []domain.LLMTool, response *responses.Response, currentMessages []responses.ResponseInputItemUnionParam) ([]responses.ResponseInputItemUnionParam, bool, error) {
 	hasFunctionCalls := false
 	for _, op := range response.Output {
@@ -170,39 +202,25 @@ func (o *OpenAI) processToolCall(
 	tools []domain.LLMTool,
 	toolCall responses.ResponseFunctionToolCall,
 ) (domain.ChatMessage, error) {
-	for _, tool := range tools {
-		if tool.Name() == toolCall.Name {
-			result, err := tool.Execute(ctx, toolCall.Arguments)
-			if err != nil {
-				return domain.ChatMessage{}, fmt.Errorf("error executing tool: %w", err)
-			}
-			toolName := tool.Name()
-			return domain.ChatMessage{
-				Name:   &toolName,
-				Result: &result,
-				CallID: &toolCall.ID,
-			}, nil
-		}
-	}
-
-	message, err := json.Marshal(map[string]any{
-		"error": fmt.Sprintf("tool does not exist: %s", toolCall.Name),
-	})
+	result, err := executeToolCall(ctx, tools, toolCall.Name, toolCall.Arguments)
 	if err != nil {
-		return domain.ChatMessage{}, fmt.Errorf("failed to marshal error message: %w", err)
+		return domain.ChatMessage{}, err
 	}
 
-	messageStr := string(message)
-
 	return domain.ChatMessage{
 		Name:   &toolCall.Name,
+		Result: &result,
 		CallID: &toolCall.ID,
-		Result: &messageStr,
 	}, nil
 }
 
 func (o *OpenAI) chatMessageToOpenAIMessage(message domain.ChatMessage) responses.ResponseInputItemUnionParam {
 	switch {
+	case message.Role == "system":
+		return responses.ResponseInputItemParamOfMessage(
+			message.Content,
+			responses.EasyInputMessageRoleDeveloper,
+		)
 	case message.Role == "user":
 		return responses.ResponseInputItemParamOfMessage(
 			message.Content,
@@ -256,6 +274,7 @@ func (o *OpenAI) openAIMessageToChatMessage(message responses.ResponseInputItemU
 
 	case message.OfFunctionCall != nil:
 		return domain.ChatMessage{
+			Role:   "tool_call",
 			Name:   &message.OfFunctionCall.Name,
 			Args:   &message.OfFunctionCall.Arguments,
 			CallID: &message.OfFunctionCall.CallID,
@@ -267,6 +286,7 @@ func (o *OpenAI) openAIMessageToChatMessage(message responses.ResponseInputItemU
 			result = message.OfFunctionCallOutput.Output.OfString.Value
 		}
 		return domain.ChatMessage{
+			Role:   "tool_result",
 			CallID: &message.OfFunctionCallOutput.CallID,
 			Result: &result,
 		}
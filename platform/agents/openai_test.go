@@ -0,0 +1,125 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3/option"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// newOpenAIStub points an agent at a stand-in for the Responses API, which
+// answers every request with respond and counts them.
+func newOpenAIStub(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*OpenAI, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/responses" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		requests.Add(1)
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewOpenAI("test-key", option.WithBaseURL(server.URL+"/v1/"), option.WithMaxRetries(0)), requests
+}
+
+// streamResponse runs StreamResponse, failing the test if it doesn't return in
+// time.
+func streamResponse(t *testing.T, ctx context.Context, agent *OpenAI, callback func(delta string)) error {
+	t.Helper()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := agent.StreamResponse(
+			ctx,
+			[]domain.ChatMessage{{Role: "user", Content: "Hi"}},
+			nil,
+			domain.GenerationSettings{},
+			callback,
+		)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamResponse didn't return")
+		return nil
+	}
+}
+
+func TestOpenAIStreamResponseStopsWhenCancelled(t *testing.T) {
+	agent, requests := newOpenAIStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: response.output_text.delta\n"+
+			`data: {"type":"response.output_text.delta","item_id":"msg_1","output_index":0,`+
+			`"content_index":0,"delta":"Hel","sequence_number":1}`+"\n\n")
+		w.(http.Flusher).Flush()
+
+		// The response is never completed, the run is stopped first.
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deltas := []string{}
+	err := streamResponse(t, ctx, agent, func(delta string) {
+		deltas = append(deltas, delta)
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if len(deltas) != 1 || deltas[0] != "Hel" {
+		t.Errorf("deltas = %q", deltas)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestOpenAIStreamResponseReturnsAPIErrors(t *testing.T) {
+	agent, requests := newOpenAIStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error",`+
+			`"param":null,"code":"invalid_api_key"}}`)
+	})
+
+	err := streamResponse(t, context.Background(), agent, func(delta string) {})
+	if err == nil {
+		t.Fatal("got no error, want the API error")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestOpenAIStreamResponseFailsOnIncompleteStream(t *testing.T) {
+	agent, requests := newOpenAIStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: response.failed\n"+
+			`data: {"type":"response.failed","sequence_number":1,"response":{"id":"resp_1",`+
+			`"object":"response","status":"failed","output":[],`+
+			`"error":{"code":"server_error","message":"The model failed"}}}`+"\n\n")
+	})
+
+	err := streamResponse(t, context.Background(), agent, func(delta string) {})
+	if err == nil {
+		t.Fatal("got no error, want the response to fail")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
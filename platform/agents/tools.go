@@ -3,6 +3,10 @@ package agents
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/raphael-foliveira/htmbot/domain"
 )
 
 type LLMTool struct {
@@ -54,3 +58,50 @@ func (t *LLMTool) Parameters() map[string]any {
 func (t *LLMTool) Execute(ctx context.Context, args string) (string, error) {
 	return t.execute(ctx, args)
 }
+
+func executeToolCall(ctx context.Context, tools []domain.LLMTool, name, args string) (string, error) {
+	for _, tool := range tools {
+		if tool.Name() == name {
+			result, err := tool.Execute(ctx, args)
+			if err != nil {
+				return "", fmt.Errorf("error executing tool: %w", err)
+			}
+			return result, nil
+		}
+	}
+
+	message, err := json.Marshal(map[string]any{
+		"error": fmt.Sprintf("tool does not exist: %s", name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal error message: %w", err)
+	}
+
+	return string(message), nil
+}
+
+// dropOrphanToolMessages removes tool calls that have no result and results
+// that have no call, which happens when the history window cuts through a
+// tool exchange.
+func dropOrphanToolMessages(messages []domain.ChatMessage) []domain.ChatMessage {
+	calls, results := map[string]bool{}, map[string]bool{}
+	for _, message := range messages {
+		switch {
+		case message.Args != nil:
+			calls[*message.CallID] = true
+		case message.Result != nil:
+			results[*message.CallID] = true
+		}
+	}
+
+	return slices.DeleteFunc(slices.Clone(messages), func(message domain.ChatMessage) bool {
+		switch {
+		case message.Args != nil:
+			return !results[*message.CallID]
+		case message.Result != nil:
+			return !calls[*message.CallID]
+		default:
+			return message.Role == ""
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// RequireWorkspaceRole rejects requests whose role in the workspace they act
+// in is less privileged than role.
+func RequireWorkspaceRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			membership, _ := domain.WorkspaceFromContext(c.Request().Context())
+			if !membership.Allows(role) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("requires the %s role", role))
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// RequireScope rejects requests made with an API key that lacks the scope.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !domain.HasScope(c.Request().Context(), scope) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("api key lacks the %s scope", scope))
+			}
+			return next(c)
+		}
+	}
+}
@@ -10,9 +10,20 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func WriteEventStream(w http.ResponseWriter, event, data string) error {
-	if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
-		return err
+// WriteEventStream writes an event to the stream. The id field is left out
+// when id is empty, so the client keeps the ID of the last event that had one,
+// and the event field when event is empty, which clients read as "message".
+func WriteEventStream(w http.ResponseWriter, id, event, data string) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
 	}
 
 	lines := strings.SplitSeq(data, "\n")
@@ -26,13 +37,13 @@ func WriteEventStream(w http.ResponseWriter, event, data string) error {
 	return err
 }
 
-func WriteEventStreamTemplate(c echo.Context, event string, template templ.Component) error {
+func WriteEventStreamTemplate(c echo.Context, id, event string, template templ.Component) error {
 	var buf bytes.Buffer
 	if err := template.Render(c.Request().Context(), &buf); err != nil {
 		return err
 	}
 
-	return WriteEventStream(c.Response(), event, buf.String())
+	return WriteEventStream(c.Response(), id, event, buf.String())
 }
 
 func SetupSSE(c echo.Context) {
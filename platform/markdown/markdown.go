@@ -0,0 +1,205 @@
+package markdown
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+)
+
+var converter = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		highlighting.NewHighlighting(
+			highlighting.WithStyle("github-dark"),
+			highlighting.WithFormatOptions(chromahtml.WithLineNumbers(false)),
+		),
+	),
+)
+
+// policy allows what goldmark produces from Markdown, plus the inline colours
+// chroma uses to highlight code. Raw HTML in the source is already dropped by
+// goldmark, the policy is there in case that ever changes.
+var policy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowStyles("color", "background-color", "font-weight", "font-style", "text-decoration").
+		OnElements("span", "pre")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}()
+
+// Render converts Markdown to sanitised HTML. Input that can't be converted is
+// rendered as escaped text.
+func Render(source string) string {
+	var buf bytes.Buffer
+	if err := converter.Convert([]byte(source), &buf); err != nil {
+		return policy.Sanitize("<p>" + escape(source) + "</p>")
+	}
+	return policy.Sanitize(buf.String())
+}
+
+// RenderPartial renders Markdown that is still being written. A code block
+// that hasn't been closed yet is closed, so the text after the fence is shown
+// as code instead of the fence being shown as text.
+func RenderPartial(source string) string {
+	if fence := openFence(source); fence != "" {
+		if !strings.HasSuffix(source, "\n") {
+			source += "\n"
+		}
+		source += fence
+	}
+	return Render(source)
+}
+
+// SettledLength returns how much of source is made of complete blocks, which
+// can be rendered once and left alone while the rest is still streaming. A
+// blank line outside of a code block usually ends a block, but the line after
+// it can carry the block on: an indented line can continue indented code or a
+// list item, and another item continues the list, which would render as two
+// lists if it were split. So a blank line only settles what comes before it
+// once it's followed by a line that starts a new block. Reference links are
+// resolved against definitions anywhere in the document, so nothing is
+// settled from the first block that could use or define one.
+func SettledLength(source string) int {
+	settled := 0
+	fence := ""
+	blank, list, code, reference := false, false, false, false
+	offset := 0
+	for offset < len(source) {
+		line, complete := source[offset:], false
+		if end := strings.IndexByte(line, '\n'); end != -1 {
+			line, complete = line[:end], true
+		}
+		start := offset
+		offset += len(line) + 1
+
+		// The start of an unfinished line can only tell that a new block has
+		// begun, anything else could still become a list item or indented.
+		if !complete {
+			if blank && !strings.ContainsAny(line[:1], " \t-*+0123456789") && !reference {
+				settled = start
+			}
+			break
+		}
+
+		open := fence
+		fence = nextFence(fence, line)
+		if open != "" {
+			blank = false
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			continue
+		}
+
+		item := isListItem(line)
+		indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if blank && !(indented && (list || code)) && !(item && list) {
+			if reference {
+				return settled
+			}
+			settled = start
+			list = false
+		}
+		blank = false
+		list = list || item
+		code = !list && (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"))
+		reference = reference || hasReference(line)
+	}
+	return settled
+}
+
+var (
+	listItem = regexp.MustCompile(`^ {0,3}(?:[-*+]|\d{1,9}[.)])(?:[ \t]|$)`)
+	// codeSpan is approximate, it's only used to ignore brackets in code.
+	codeSpan  = regexp.MustCompile("`[^`]*`")
+	bracketed = regexp.MustCompile(`\[[^\]]+\]`)
+	taskBox   = regexp.MustCompile(`^\[[ xX]\]$`)
+)
+
+func isListItem(line string) bool {
+	return listItem.MatchString(line)
+}
+
+// hasReference reports whether the line has brackets that aren't an inline
+// link or a task list box, and so could be a reference link or definition.
+func hasReference(line string) bool {
+	line = codeSpan.ReplaceAllString(line, "")
+	for _, match := range bracketed.FindAllStringIndex(line, -1) {
+		next := byte(0)
+		if match[1] < len(line) {
+			next = line[match[1]]
+		}
+		if next == '(' {
+			continue
+		}
+		if next != '[' && taskBox.MatchString(line[match[0]:match[1]]) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// openFence returns the fence of the code block left open at the end of
+// source, if any.
+func openFence(source string) string {
+	fence := ""
+	for line := range strings.SplitSeq(source, "\n") {
+		fence = nextFence(fence, line)
+	}
+	return fence
+}
+
+// nextFence returns the fence that is open after line, given the fence that
+// was open before it.
+func nextFence(open, line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return open
+	}
+
+	marker := fenceMarker(trimmed)
+	if marker == "" {
+		return open
+	}
+
+	if open == "" {
+		return marker
+	}
+
+	// A closing fence is at least as long as the opening one and has
+	// nothing after it.
+	if marker[0] == open[0] && len(marker) >= len(open) && strings.TrimSpace(trimmed[len(marker):]) == "" {
+		return ""
+	}
+	return open
+}
+
+func fenceMarker(line string) string {
+	for _, char := range []byte{'`', '~'} {
+		length := 0
+		for length < len(line) && line[length] == char {
+			length++
+		}
+		if length >= 3 {
+			return line[:length]
+		}
+	}
+	return ""
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;")
+
+func escape(text string) string {
+	return escaper.Replace(text)
+}
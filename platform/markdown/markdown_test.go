@@ -0,0 +1,158 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSettledLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		settled string
+	}{
+		{name: "empty", source: "", settled: ""},
+		{name: "unfinished paragraph", source: "Hello", settled: ""},
+		{name: "paragraph followed by a blank line", source: "Hello\n\n", settled: ""},
+		{name: "next block started", source: "Hello\n\nWorld", settled: "Hello\n\n"},
+		{name: "several blank lines", source: "Hello\n\n\n\nWorld\n", settled: "Hello\n\n\n\n"},
+		{name: "last of several blocks", source: "One\n\nTwo\n\nThree\n", settled: "One\n\nTwo\n\n"},
+		{
+			name:    "blank line inside a code block",
+			source:  "```go\nfunc a() {}\n\nfunc b() {}\n",
+			settled: "",
+		},
+		{
+			name:    "closed code block",
+			source:  "```go\nfunc a() {}\n\nfunc b() {}\n```\n\nDone",
+			settled: "```go\nfunc a() {}\n\nfunc b() {}\n```\n\n",
+		},
+		{name: "loose list", source: "- one\n\n- two\n\n- three", settled: ""},
+		{name: "loose ordered list", source: "1. one\n\n2. two\n", settled: ""},
+		{name: "list ended by a paragraph", source: "- one\n\n- two\n\nAfter\n", settled: "- one\n\n- two\n\n"},
+		{name: "list after a paragraph", source: "Intro\n\n- one\n\n- two\n", settled: "Intro\n\n"},
+		{name: "list item continued", source: "- one\n\n  more of one\n", settled: ""},
+		{
+			name:    "indented code with a blank line",
+			source:  "Code:\n\n    a := 1\n\n    b := 2\n",
+			settled: "Code:\n\n",
+		},
+		{
+			name:    "indented code ended by a paragraph",
+			source:  "    a := 1\n\n    b := 2\n\nAfter\n",
+			settled: "    a := 1\n\n    b := 2\n\n",
+		},
+		{name: "reference link", source: "See [the docs].\n\nMore\n\n[the docs]: https://example.com\n", settled: ""},
+		{
+			name:    "reference link after settled blocks",
+			source:  "Intro\n\nSee [the docs][docs].\n\nMore\n",
+			settled: "Intro\n\n",
+		},
+		{
+			name:    "inline link",
+			source:  "See [the docs](https://example.com).\n\nMore\n",
+			settled: "See [the docs](https://example.com).\n\n",
+		},
+		{name: "task list", source: "- [x] done\n- [ ] todo\n\nMore\n", settled: "- [x] done\n- [ ] todo\n\n"},
+		{name: "brackets in code", source: "Use `a[i]`.\n\nMore\n", settled: "Use `a[i]`.\n\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.source[:SettledLength(test.source)]; got != test.settled {
+				t.Errorf("SettledLength(%q) settles %q, want %q", test.source, got, test.settled)
+			}
+		})
+	}
+}
+
+// TestSettledLengthRendersTheSame checks that rendering the settled part and
+// the rest separately matches rendering the whole source.
+func TestSettledLengthRendersTheSame(t *testing.T) {
+	sources := []string{
+		"# Title\n\nSome *text*.\n\n- one\n\n- two\n\n```go\na := 1\n\nb := 2\n```\n\nEnd\n",
+		"1. one\n\n2. two\n\n3. three\n\nAfter the list\n",
+		"Code:\n\n    a := 1\n\n    b := 2\n\nAfter the code\n",
+		"See [the docs].\n\nMore\n\n[the docs]: https://example.com\n",
+		"> quoted\n\n> again\n\nPlain\n",
+	}
+
+	for _, source := range sources {
+		// Every prefix is a point the stream could have reached.
+		for i := range len(source) + 1 {
+			prefix := source[:i]
+			settled := SettledLength(prefix)
+			if Render(source[:settled])+Render(source[settled:]) != Render(source) {
+				t.Errorf("settling %q of %q changes how it renders", source[:settled], source)
+				break
+			}
+		}
+	}
+}
+
+func TestNextFence(t *testing.T) {
+	tests := []struct {
+		name string
+		open string
+		line string
+		want string
+	}{
+		{name: "text", open: "", line: "hello", want: ""},
+		{name: "backticks", open: "", line: "```", want: "```"},
+		{name: "with info string", open: "", line: "```go", want: "```"},
+		{name: "tildes", open: "", line: "~~~~", want: "~~~~"},
+		{name: "too short", open: "", line: "``", want: ""},
+		{name: "indented up to 3 spaces", open: "", line: "   ```", want: "```"},
+		{name: "indented 4 spaces", open: "", line: "    ```", want: ""},
+		{name: "close", open: "```", line: "```", want: ""},
+		{name: "close with a longer fence", open: "```", line: "`````", want: ""},
+		{name: "shorter fence doesn't close", open: "````", line: "```", want: "````"},
+		{name: "other marker doesn't close", open: "```", line: "~~~", want: "```"},
+		{name: "info string doesn't close", open: "```", line: "```go", want: "```"},
+		{name: "text inside", open: "```", line: "code", want: "```"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := nextFence(test.open, test.line); got != test.want {
+				t.Errorf("nextFence(%q, %q) = %q, want %q", test.open, test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderPartial(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		contains []string
+		excludes []string
+	}{
+		{name: "text", source: "Hello *world*", contains: []string{"<p>Hello <em>world</em></p>"}},
+		{name: "open code block", source: "```\nsome code", contains: []string{"<pre", "some code"}, excludes: []string{"```"}},
+		{
+			name:     "open code block ending in a newline",
+			source:   "Look:\n\n~~~\ncode\n",
+			contains: []string{"<p>Look:</p>", "<pre", "code"},
+			excludes: []string{"~~~"},
+		},
+		{name: "closed code block", source: "```\ncode\n```\n\nafter", contains: []string{"<pre", "<p>after</p>"}},
+		{name: "raw HTML", source: "<script>alert(1)</script>", excludes: []string{"<script>"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := RenderPartial(test.source)
+			for _, want := range test.contains {
+				if !strings.Contains(got, want) {
+					t.Errorf("RenderPartial(%q) = %q, want it to contain %q", test.source, got, want)
+				}
+			}
+			for _, unwanted := range test.excludes {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("RenderPartial(%q) = %q, want it not to contain %q", test.source, got, unwanted)
+				}
+			}
+		})
+	}
+}
@@ -1,47 +1,388 @@
 package pubsub
 
-import "sync"
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+type subscription[T any] struct {
+	ch      chan domain.Event[T]
+	missed  chan struct{}
+	options domain.SubscribeOptions
+
+	// The events of a Block subscriber whose buffer is full wait in the
+	// backlog, which is drained by its own goroutine so publishers don't wait
+	// on the subscriber while holding the topic lock.
+	mu       sync.Mutex
+	backlog  []domain.Event[T]
+	draining bool
+	closed   bool
+	done     chan struct{}
+}
+
+func (s *subscription[T]) signalMissed() {
+	select {
+	case s.missed <- struct{}{}:
+	default:
+	}
+}
+
+// topic keeps the last published events so subscribers can resume after
+// reconnecting. Publishing and subscribing lock the topic, so a subscriber gets
+// the replayed events and the new ones without gaps or duplicates.
+type topic[T any] struct {
+	subscriptions []*subscription[T]
+	history       []domain.Event[T]
+	lastID        int64
+	// forgottenID is the highest ID that can't be replayed, either because
+	// it was evicted from the history or because it came before the first
+	// event the topic saw.
+	forgottenID   int64
+	lastPublished time.Time
+	removed       bool
+	mu            sync.Mutex
+}
+
+// ChannelStats counts the messages subscribers didn't get.
+type ChannelStats struct {
+	Dropped      uint64
+	Disconnected uint64
+}
+
+type ChannelConfig struct {
+	// ReplaySize is how many events of each topic are kept for replay.
+	ReplaySize int
+	// ReplayTTL is how long the events of a topic without subscribers are
+	// kept after the last publish.
+	ReplayTTL time.Duration
+}
+
+func (c *ChannelConfig) ApplyDefaults() {
+	if c.ReplaySize == 0 {
+		c.ReplaySize = 256
+	}
+
+	if c.ReplayTTL == 0 {
+		c.ReplayTTL = 5 * time.Minute
+	}
+}
 
 type Channel[T any] struct {
-	subscriptions map[string][]chan T
-	mu            sync.RWMutex
+	config ChannelConfig
+	topics map[string]*topic[T]
+	// lastID is shared by all topics, so an ID is never reused even after
+	// an expired topic is created again.
+	lastID       atomic.Int64
+	lastSweep    time.Time
+	mu           sync.Mutex
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
 }
 
-func NewChannel[T any](subscriptions map[string][]chan T) *Channel[T] {
+func NewChannel[T any](config ChannelConfig) *Channel[T] {
+	config.ApplyDefaults()
 	return &Channel[T]{
-		subscriptions: subscriptions,
+		config:    config,
+		topics:    map[string]*topic[T]{},
+		lastSweep: time.Now(),
+	}
+}
+
+// lockTopic returns the topic, created if needed, with its lock held.
+func (p *Channel[T]) lockTopic(name string) *topic[T] {
+	for {
+		t := p.topic(name)
+		t.mu.Lock()
+		if !t.removed {
+			return t
+		}
+		t.mu.Unlock()
 	}
 }
 
-func (p *Channel[T]) Subscribe(topic string) (chan T, func(), error) {
+// topic returns the state of the topic, creating it if needed, and removes the
+// topics that expired since the last sweep.
+func (p *Channel[T]) topic(name string) *topic[T] {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if _, ok := p.subscriptions[topic]; !ok {
-		p.subscriptions[topic] = []chan T{}
-	}
-	newChannel := make(chan T, 1000)
-	p.subscriptions[topic] = append(p.subscriptions[topic], newChannel)
-	return newChannel, func() {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		for i, channel := range p.subscriptions[topic] {
-			if channel == newChannel {
-				p.subscriptions[topic] = append(p.subscriptions[topic][:i], p.subscriptions[topic][i+1:]...)
-				break
-			}
+
+	if time.Since(p.lastSweep) > p.config.ReplayTTL {
+		p.sweep()
+	}
+
+	t, ok := p.topics[name]
+	if !ok {
+		t = &topic[T]{lastPublished: time.Now()}
+		p.topics[name] = t
+	}
+	return t
+}
+
+// sweep must be called with the channel lock held. Topics that are busy are
+// left for the next sweep.
+func (p *Channel[T]) sweep() {
+	p.lastSweep = time.Now()
+	for name, t := range p.topics {
+		if !t.mu.TryLock() {
+			continue
+		}
+		if len(t.subscriptions) == 0 && time.Since(t.lastPublished) > p.config.ReplayTTL {
+			t.removed = true
+			delete(p.topics, name)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// forget drops the replay history of every topic and tells their subscribers
+// they missed events, for when events may have been lost without knowing
+// which. Until the next event arrives, every resume is treated as a miss.
+func (p *Channel[T]) forget() {
+	p.mu.Lock()
+	topics := slices.Collect(maps.Values(p.topics))
+	p.mu.Unlock()
+
+	for _, t := range topics {
+		t.mu.Lock()
+		t.history = nil
+		t.lastID = 0
+		for _, subscription := range t.subscriptions {
+			subscription.signalMissed()
 		}
-		close(newChannel)
+		t.mu.Unlock()
+	}
+}
+
+func (p *Channel[T]) Subscribe(name string, options domain.SubscribeOptions) (domain.Subscription[T], error) {
+	options.ApplyDefaults()
+
+	t := p.lockTopic(name)
+	defer t.mu.Unlock()
+
+	newSubscription := &subscription[T]{
+		ch:      make(chan domain.Event[T], options.BufferSize),
+		missed:  make(chan struct{}, 1),
+		options: options,
+		done:    make(chan struct{}),
+	}
+	if options.After > 0 {
+		p.replay(t, newSubscription, options.After)
+	}
+	t.subscriptions = append(t.subscriptions, newSubscription)
+
+	return domain.Subscription[T]{
+		Messages: newSubscription.ch,
+		Missed:   newSubscription.missed,
+		Unsubscribe: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.remove(newSubscription)
+		},
 	}, nil
 }
 
-func (p *Channel[T]) Publish(topic string, message T) error {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, channel := range p.subscriptions[topic] {
+// replay sends the events published after the given ID. The subscriber is told
+// it missed events when some of them are no longer kept, when the ID is unknown
+// or when they don't fit in its buffer.
+func (p *Channel[T]) replay(t *topic[T], subscription *subscription[T], after int64) {
+	if after > t.lastID || after < t.forgottenID {
+		subscription.signalMissed()
+	}
+
+	for _, event := range t.history {
+		if event.ID <= after {
+			continue
+		}
 		select {
-		case channel <- message:
+		case subscription.ch <- event:
 		default:
+			subscription.signalMissed()
+			return
+		}
+	}
+}
+
+// remove closes the subscription if it's still subscribed to the topic. The
+// caller must hold the topic lock.
+func (t *topic[T]) remove(target *subscription[T]) bool {
+	for i, subscription := range t.subscriptions {
+		if subscription == target {
+			t.subscriptions = append(t.subscriptions[:i], t.subscriptions[i+1:]...)
+			target.close()
+			return true
 		}
 	}
+	return false
+}
+
+// close closes the channel right away unless the backlog is being drained, in
+// which case the draining goroutine closes it once it stops sending.
+func (s *subscription[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	close(s.done)
+	if !s.draining {
+		close(s.ch)
+	}
+}
+
+func (p *Channel[T]) Publish(name string, message T) error {
+	t := p.lockTopic(name)
+	defer t.mu.Unlock()
+
+	p.deliver(t, domain.Event[T]{ID: p.lastID.Add(1), Message: message})
 	return nil
 }
+
+// publishEvent delivers an event that was given its ID elsewhere. Events with
+// an ID lower than the last one delivered are delivered without being kept for
+// replay.
+func (p *Channel[T]) publishEvent(name string, event domain.Event[T]) {
+	t := p.lockTopic(name)
+	defer t.mu.Unlock()
+
+	p.deliver(t, event)
+}
+
+// deliver must be called with the topic lock held.
+func (p *Channel[T]) deliver(t *topic[T], event domain.Event[T]) {
+	t.lastPublished = time.Now()
+	if event.ID > t.lastID {
+		if t.lastID == 0 {
+			t.forgottenID = event.ID - 1
+		}
+		t.lastID = event.ID
+		t.history = append(t.history, event)
+		if evicted := len(t.history) - p.config.ReplaySize; evicted > 0 {
+			t.forgottenID = t.history[evicted-1].ID
+			t.history = t.history[evicted:]
+		}
+	}
+
+	for _, subscription := range append([]*subscription[T]{}, t.subscriptions...) {
+		// Events can't overtake the ones waiting in the backlog.
+		if subscription.options.Policy == domain.Block && p.queueBlocking(subscription, event) {
+			continue
+		}
+
+		select {
+		case subscription.ch <- event:
+			continue
+		default:
+		}
+
+		switch subscription.options.Policy {
+		case domain.Disconnect:
+			if t.remove(subscription) {
+				p.disconnected.Add(1)
+				subscription.signalMissed()
+			}
+
+		case domain.Block:
+			p.sendBlocking(subscription, event)
+
+		case domain.DropOldest:
+			p.sendDroppingOldest(subscription, event)
+
+		default:
+			p.drop(subscription)
+		}
+	}
+}
+
+// queueBlocking adds the event to the backlog if the subscriber has one.
+func (p *Channel[T]) queueBlocking(subscription *subscription[T], event domain.Event[T]) bool {
+	subscription.mu.Lock()
+	defer subscription.mu.Unlock()
+
+	if !subscription.draining {
+		return false
+	}
+
+	// The backlog is bounded like the buffer, so a stalled subscriber can't
+	// make it grow without limit.
+	if len(subscription.backlog) >= subscription.options.BufferSize {
+		p.drop(subscription)
+		return true
+	}
+	subscription.backlog = append(subscription.backlog, event)
+	return true
+}
+
+// sendBlocking starts a backlog with the event, which waits up to BlockTimeout
+// for room in the buffer like every event queued after it.
+func (p *Channel[T]) sendBlocking(subscription *subscription[T], event domain.Event[T]) {
+	subscription.mu.Lock()
+	subscription.backlog = append(subscription.backlog, event)
+	subscription.draining = true
+	subscription.mu.Unlock()
+
+	go p.drain(subscription)
+}
+
+// drain sends the backlog in order until it's empty, and closes the channel
+// instead if the subscription was closed meanwhile.
+func (p *Channel[T]) drain(subscription *subscription[T]) {
+	for {
+		subscription.mu.Lock()
+		if subscription.closed {
+			subscription.draining = false
+			subscription.backlog = nil
+			close(subscription.ch)
+			subscription.mu.Unlock()
+			return
+		}
+		if len(subscription.backlog) == 0 {
+			subscription.draining = false
+			subscription.mu.Unlock()
+			return
+		}
+		event := subscription.backlog[0]
+		subscription.backlog = subscription.backlog[1:]
+		subscription.mu.Unlock()
+
+		timer := time.NewTimer(subscription.options.BlockTimeout)
+		select {
+		case subscription.ch <- event:
+		case <-subscription.done:
+		case <-timer.C:
+			p.drop(subscription)
+		}
+		timer.Stop()
+	}
+}
+
+func (p *Channel[T]) sendDroppingOldest(subscription *subscription[T], event domain.Event[T]) {
+	for {
+		select {
+		case subscription.ch <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-subscription.ch:
+			p.drop(subscription)
+		default:
+		}
+	}
+}
+
+func (p *Channel[T]) drop(subscription *subscription[T]) {
+	p.dropped.Add(1)
+	subscription.signalMissed()
+}
+
+func (p *Channel[T]) Stats() ChannelStats {
+	return ChannelStats{
+		Dropped:      p.dropped.Load(),
+		Disconnected: p.disconnected.Load(),
+	}
+}
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+func TestChannelBlockDoesNotHoldUpPublishers(t *testing.T) {
+	channel := NewChannel[int](ChannelConfig{})
+	subscription, err := channel.Subscribe("topic", domain.SubscribeOptions{
+		Policy:       domain.Block,
+		BufferSize:   2,
+		BlockTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	start := time.Now()
+	for i := range 4 {
+		channel.Publish("topic", i)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publishing to a full subscriber took %s", elapsed)
+	}
+
+	// The waiting events are delivered in order as the subscriber catches up.
+	for want := range 4 {
+		select {
+		case event := <-subscription.Messages:
+			if event.Message != want {
+				t.Fatalf("got message %d, want %d", event.Message, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d wasn't delivered", want)
+		}
+	}
+
+	for i := range 3 {
+		channel.Publish("topic", i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		subscription.Unsubscribe()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe waited on the blocked send")
+	}
+
+	// The channel is closed once the pending send is abandoned.
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-subscription.Messages:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Messages wasn't closed")
+		}
+	}
+}
+
+func TestChannelBlockDropsAfterTimeout(t *testing.T) {
+	channel := NewChannel[int](ChannelConfig{})
+	subscription, _ := channel.Subscribe("topic", domain.SubscribeOptions{
+		Policy:       domain.Block,
+		BufferSize:   1,
+		BlockTimeout: 10 * time.Millisecond,
+	})
+	defer subscription.Unsubscribe()
+
+	channel.Publish("topic", 0)
+	channel.Publish("topic", 1)
+
+	select {
+	case <-subscription.Missed:
+	case <-time.After(time.Second):
+		t.Fatal("the subscriber wasn't told it missed a message")
+	}
+	if dropped := channel.Stats().Dropped; dropped != 1 {
+		t.Errorf("dropped = %d, want 1", dropped)
+	}
+}
+
+func TestChannelForget(t *testing.T) {
+	channel := NewChannel[int](ChannelConfig{})
+	subscription, _ := channel.Subscribe("topic", domain.SubscribeOptions{})
+	defer subscription.Unsubscribe()
+
+	channel.Publish("topic", 0)
+	last := (<-subscription.Messages).ID
+
+	channel.forget()
+	select {
+	case <-subscription.Missed:
+	default:
+		t.Error("the subscriber wasn't told it missed events")
+	}
+
+	// Resuming from an event seen before can't be trusted to be gapless.
+	resumed, _ := channel.Subscribe("topic", domain.SubscribeOptions{After: last})
+	defer resumed.Unsubscribe()
+	select {
+	case <-resumed.Missed:
+	default:
+		t.Error("the resumed subscriber wasn't told it missed events")
+	}
+}
@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/gommon/log"
+	"github.com/raphael-foliveira/htmbot/domain"
+)
+
+// postgresMaxPayload keeps notifications under the 8000 byte limit Postgres
+// puts on NOTIFY payloads.
+const postgresMaxPayload = 7900
+
+const postgresPublishTimeout = 5 * time.Second
+
+// postgresEnvelope is the payload of a notification. Messages too large to fit
+// in a notification are stored in pubsub_payloads and referenced by PayloadID.
+// ID comes from a database sequence, so every instance sees the same event
+// IDs.
+type postgresEnvelope struct {
+	ID        int64           `json:"id,omitempty"`
+	Topic     string          `json:"topic"`
+	Message   json.RawMessage `json:"message,omitempty"`
+	PayloadID int64           `json:"payload_id,omitempty"`
+}
+
+// Postgres fans messages out to the subscribers of every instance sharing the
+// database. All topics share a single notification channel and each instance
+// delivers the messages to its own subscribers, so Listen must be running for
+// subscribers to receive anything. Since every instance receives every event,
+// a subscriber can resume on any of them.
+type Postgres[T any] struct {
+	pool    *pgxpool.Pool
+	channel string
+	local   *Channel[T]
+	// listened is set once Listen has listened, so a later call knows it's
+	// reconnecting.
+	listened atomic.Bool
+}
+
+func NewPostgres[T any](pool *pgxpool.Pool, channel string, config ChannelConfig) *Postgres[T] {
+	return &Postgres[T]{
+		pool:    pool,
+		channel: channel,
+		local:   NewChannel[T](config),
+	}
+}
+
+func (p *Postgres[T]) Subscribe(topic string, options domain.SubscribeOptions) (domain.Subscription[T], error) {
+	return p.local.Subscribe(topic, options)
+}
+
+func (p *Postgres[T]) Stats() ChannelStats {
+	return p.local.Stats()
+}
+
+const nextEventIdQuery = `
+SELECT nextval('pubsub_event_ids');
+`
+
+// notifyQuery sends the payload as is, so the size checked is the size sent.
+const notifyQuery = `
+SELECT pg_notify($1, $2);
+`
+
+// storePayloadQuery also clears out payloads old enough for every listener to
+// have read them.
+const storePayloadQuery = `
+WITH expired AS (
+	DELETE FROM pubsub_payloads WHERE created_at < NOW() - INTERVAL '5 minutes'
+)
+INSERT INTO pubsub_payloads (payload) VALUES ($1) RETURNING id;
+`
+
+func (p *Postgres[T]) Publish(topic string, message T) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresPublishTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	var eventId int64
+	if err := p.pool.QueryRow(ctx, nextEventIdQuery).Scan(&eventId); err != nil {
+		return fmt.Errorf("failed to get event id: %w", err)
+	}
+
+	payload, err := json.Marshal(postgresEnvelope{ID: eventId, Topic: topic, Message: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	if len(payload) > postgresMaxPayload {
+		var payloadId int64
+		if err := p.pool.QueryRow(ctx, storePayloadQuery, string(data)).Scan(&payloadId); err != nil {
+			return fmt.Errorf("failed to store payload: %w", err)
+		}
+
+		payload, err = json.Marshal(postgresEnvelope{ID: eventId, Topic: topic, PayloadID: payloadId})
+		if err != nil {
+			return fmt.Errorf("failed to encode notification: %w", err)
+		}
+	}
+
+	if _, err := p.pool.Exec(ctx, notifyQuery, p.channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify: %w", err)
+	}
+
+	return nil
+}
+
+// Listen holds a connection listening on the notification channel and
+// delivers notifications to local subscribers until ctx is done or the
+// connection fails. Notifications sent while no connection was listening are
+// lost, so when Listen is called again the subscribers are told they missed
+// events and resync.
+func (p *Postgres[T]) Listen(ctx context.Context) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer func() {
+		// A connection that can't be reset is destroyed on release, instead
+		// of going back to the pool still listening.
+		if _, err := conn.Exec(context.Background(), "UNLISTEN *"); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{p.channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if p.listened.Swap(true) {
+		p.local.forget()
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+
+		if err := p.deliver(ctx, notification.Payload); err != nil {
+			log.Errorf("failed to deliver notification: %v", err)
+		}
+	}
+}
+
+const loadPayloadQuery = `
+SELECT payload FROM pubsub_payloads WHERE id = $1;
+`
+
+func (p *Postgres[T]) deliver(ctx context.Context, payload string) error {
+	envelope := postgresEnvelope{}
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return fmt.Errorf("failed to decode notification: %w", err)
+	}
+
+	if envelope.PayloadID != 0 {
+		var data string
+		if err := p.pool.QueryRow(ctx, loadPayloadQuery, envelope.PayloadID).Scan(&data); err != nil {
+			return fmt.Errorf("failed to load payload: %w", err)
+		}
+		envelope.Message = json.RawMessage(data)
+	}
+
+	var message T
+	if err := json.Unmarshal(envelope.Message, &message); err != nil {
+		return fmt.Errorf("failed to decode message: %w", err)
+	}
+
+	p.local.publishEvent(envelope.Topic, domain.Event[T]{ID: envelope.ID, Message: message})
+	return nil
+}